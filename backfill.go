@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// backfillMetrics are the per-Broker metrics written by the backfill, which are those with values in the reporting database.
+// The names are the same as the exporter metrics, so that the backfilled history joins up with the scraped metrics.
+var backfillMetrics = []struct {
+	name  string
+	value func(r BrokerReport) float64
+}{
+	{"busy_engines", func(r BrokerReport) float64 { return float64(r.BusyEngines) }},
+	{"total_engines", func(r BrokerReport) float64 { return float64(r.TotalEngines) }},
+	{"drivers", func(r BrokerReport) float64 { return float64(r.Drivers) }},
+	{"services_running", func(r BrokerReport) float64 { return float64(r.ServicesRunning) }},
+	{"tasks_pending", func(r BrokerReport) float64 { return float64(r.TasksPending) }},
+	{"uptime_minutes", func(r BrokerReport) float64 { return r.UptimeMinutes }},
+}
+
+// newBackfillQuery returns the query for all reports from the first argument (inclusive) to the second (exclusive),
+// oldest first, with the same columns as the latest report query.
+func newBackfillQuery(d dialect, schema string) string {
+	return compact(fmt.Sprintf(`
+		SELECT
+			broker_stats.broker_id,
+			brokers.broker_url,
+			brokers.broker_name,
+			broker_stats.num_busy_engines,
+			broker_stats.num_total_engines,
+			broker_stats.num_drivers,
+			broker_stats.uptime_minutes,
+			broker_stats.num_jobs_running,
+			broker_stats.num_tasks_pending,
+			broker_stats.time_stamp
+		FROM %s
+		INNER JOIN %s ON brokers.broker_id = broker_stats.broker_id
+		WHERE broker_stats.time_stamp >= %s AND broker_stats.time_stamp < %s
+		ORDER BY broker_stats.time_stamp, broker_stats.broker_id`,
+		d.FromTable(schema, "broker_stats"), d.FromTable(schema, "brokers"), d.Placeholder(1), d.Placeholder(2)))
+}
+
+// Reports passes each report in the reporting database from start (inclusive) to end (exclusive) to a function,
+// oldest first. The reports are read one chunk of time at a time, so that the result sets stay small.
+func (s *SQLClient) Reports(start time.Time, end time.Time, chunk time.Duration, fn func(r BrokerReport) error) error {
+	return forEachChunk(start, end, chunk, func(from time.Time, to time.Time) error {
+		return s.chunkReports(from, to, fn)
+	})
+}
+
+// forEachChunk splits the time range from start (inclusive) to end (exclusive) into chunks, and passes the start and
+// end of each to a function in order. The last chunk is shortened to end at the end of the range.
+func forEachChunk(start time.Time, end time.Time, chunk time.Duration, fn func(from time.Time, to time.Time) error) error {
+	if chunk <= 0 {
+		return fmt.Errorf("invalid chunk: %s", chunk)
+	}
+	for from := start; from.Before(end); from = from.Add(chunk) {
+		to := from.Add(chunk)
+		if to.After(end) {
+			to = end
+		}
+		if err := fn(from, to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunkReports passes each report from start (inclusive) to end (exclusive) to a function, oldest first.
+func (s *SQLClient) chunkReports(start time.Time, end time.Time, fn func(r BrokerReport) error) error {
+	rows, err := s.query(backfillQuery, s.queries[backfillQuery], s.toDatabaseTime(start), s.toDatabaseTime(end))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		_, r, err := s.scanReport(rows.Rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		log.WithField("error", err).Debug("Row processing failed")
+		return errors.Wrap(err, "row processing failed")
+	}
+	log.WithField("start", start).WithField("end", end).WithField("reports", count).Debug("Reports read")
+	return nil
+}
+
+// openMetricsBackfill writes Broker reports as OpenMetrics samples with timestamps. OpenMetrics requires the samples of
+// each metric family to be together, so the samples are written to a temporary file per family until they are joined.
+type openMetricsBackfill struct {
+	labels  []string
+	dir     string
+	files   []*os.File
+	writers []*bufio.Writer
+	last    map[string]time.Time // The timestamp of the last sample of each series, by label values
+	Samples int                  // Number of samples written for each metric
+	Skipped int                  // Number of reports skipped, as another report had the same labels and timestamp
+}
+
+// newOpenMetricsBackfill returns an openMetricsBackfill for per-Broker metrics with the label names.
+func newOpenMetricsBackfill(labels []string) (*openMetricsBackfill, error) {
+	dir, err := ioutil.TempDir("", "gridserver-backfill")
+	if err != nil {
+		return nil, errors.Wrap(err, "temporary directory creation failed")
+	}
+	b := &openMetricsBackfill{labels: labels, dir: dir, last: map[string]time.Time{}}
+	for _, m := range backfillMetrics {
+		file, err := os.Create(filepath.Join(dir, m.name))
+		if err != nil {
+			b.Close()
+			return nil, errors.Wrap(err, "temporary file creation failed")
+		}
+		b.files = append(b.files, file)
+		b.writers = append(b.writers, bufio.NewWriter(file))
+	}
+	return b, nil
+}
+
+// Add writes the samples of a report. The samples of each series must be added oldest first.
+func (b *openMetricsBackfill) Add(r BrokerReport) error {
+	values := brokerLabelValues(b.labels, r)
+	key := strings.Join(values, labelSeparator)
+	if last, ok := b.last[key]; ok && !r.Timestamp.After(last) {
+		b.Skipped++
+		log.WithField("hostname", r.Hostname).
+			WithField("name", r.Name).
+			WithField("id", r.ID).
+			WithField("timestamp", r.Timestamp).
+			Debug("Report skipped, as another Broker has the same labels and timestamp")
+		return nil
+	}
+	b.last[key] = r.Timestamp
+
+	pairs := make([]string, len(b.labels))
+	for i, label := range b.labels {
+		pairs[i] = label + `="` + escapeLabelValue(values[i]) + `"`
+	}
+	labels := "{" + strings.Join(pairs, ",") + "}"
+	timestamp := fmt.Sprintf("%d.%03d", r.Timestamp.Unix(), r.Timestamp.Nanosecond()/int(time.Millisecond))
+	for i, m := range backfillMetrics {
+		line := namespace + "_broker_" + m.name + labels + " " + strconv.FormatFloat(m.value(r), 'g', -1, 64) + " " + timestamp + "\n"
+		if _, err := b.writers[i].WriteString(line); err != nil {
+			return errors.Wrap(err, "temporary file write failed")
+		}
+	}
+	b.Samples++
+	return nil
+}
+
+// WriteTo joins the metric families, and writes them to w, followed by the end of the OpenMetrics exposition.
+func (b *openMetricsBackfill) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	for i, m := range backfillMetrics {
+		if err := b.writers[i].Flush(); err != nil {
+			return written, errors.Wrap(err, "temporary file write failed")
+		}
+		if _, err := b.files[i].Seek(0, io.SeekStart); err != nil {
+			return written, errors.Wrap(err, "temporary file read failed")
+		}
+		name := namespace + "_broker_" + m.name
+		n, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, brokerMetricHelp[m.name], name)
+		written += int64(n)
+		if err != nil {
+			return written, errors.Wrap(err, "output write failed")
+		}
+		copied, err := io.Copy(w, b.files[i])
+		written += copied
+		if err != nil {
+			return written, errors.Wrap(err, "output write failed")
+		}
+	}
+	n, err := io.WriteString(w, "# EOF\n")
+	written += int64(n)
+	if err != nil {
+		return written, errors.Wrap(err, "output write failed")
+	}
+	return written, nil
+}
+
+// Close removes the temporary files.
+func (b *openMetricsBackfill) Close() error {
+	for _, file := range b.files {
+		file.Close()
+	}
+	return os.RemoveAll(b.dir)
+}
+
+// escapeLabelValue escapes a label value for the OpenMetrics text format.
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// parseBackfillTime parses a backfill start or end time in RFC 3339 format, or a date (midnight UTC).
+func parseBackfillTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time: %q", value)
+	}
+	return t, nil
+}
+
+// Backfill writes the reports in the reporting database from start (inclusive) to end (exclusive) to w as OpenMetrics,
+// for creating Prometheus TSDB blocks with promtool. Returns the number of samples written for each metric, and the
+// number of reports skipped.
+func (s *SQLClient) Backfill(start time.Time, end time.Time, chunk time.Duration, brokerID bool, w io.Writer) (int, int, error) {
+	if !start.Before(end) {
+		return 0, 0, fmt.Errorf("start %s not before end %s", start, end)
+	}
+	if s.TimeZone == autoTimeZone {
+		// Only the current offset is detected, so a named time zone is better if the history spans daylight saving changes.
+		if err := s.detectTimeZone(); err != nil {
+			return 0, 0, errors.Wrap(err, "database time zone detection failed")
+		}
+	}
+
+	b, err := newOpenMetricsBackfill(brokerLabelNames(brokerID))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer b.Close()
+
+	if err := s.Reports(start, end, chunk, b.Add); err != nil {
+		return 0, 0, err
+	}
+	if _, err := b.WriteTo(w); err != nil {
+		return 0, 0, err
+	}
+	return b.Samples, b.Skipped, nil
+}
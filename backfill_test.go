@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+func TestSQLClient_Backfill(t *testing.T) {
+	start := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	duplicate := latestRow(1, start.Add(30500*time.Millisecond))
+	duplicate[0] = int64(4) // Another Broker with the same name and hostname
+	db, fake := newFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		if args[0].(time.Time).Equal(start) {
+			return fakeResult{columns: latestColumns, rows: [][]driver.Value{latestRow(1, start.Add(30500*time.Millisecond)), duplicate}}
+		}
+		return fakeResult{columns: latestColumns, rows: [][]driver.Value{latestRow(1, start.Add(time.Hour))}}
+	})
+	s := newTestSQLClient("postgres", "", "public", time.Second)
+	s.db = db
+
+	var out bytes.Buffer
+	samples, skipped, err := s.Backfill(start, start.Add(90*time.Minute), time.Hour, false, &out)
+	if err != nil {
+		t.Fatalf("Backfill() error = %v", err)
+	}
+	if samples != 2 || skipped != 1 {
+		t.Errorf("Backfill() = %d samples, %d skipped, want 2 samples, 1 skipped", samples, skipped)
+	}
+
+	want := `# HELP gridserver_broker_busy_engines Number of Engines busy.
+# TYPE gridserver_broker_busy_engines gauge
+gridserver_broker_busy_engines{name="broker1",hostname="broker1"} 1 1590969630.500
+gridserver_broker_busy_engines{name="broker1",hostname="broker1"} 1 1590973200.000
+# HELP gridserver_broker_total_engines Number of Engines logged in.
+# TYPE gridserver_broker_total_engines gauge
+gridserver_broker_total_engines{name="broker1",hostname="broker1"} 2 1590969630.500
+gridserver_broker_total_engines{name="broker1",hostname="broker1"} 2 1590973200.000
+# HELP gridserver_broker_drivers Number of Drivers logged in.
+# TYPE gridserver_broker_drivers gauge
+gridserver_broker_drivers{name="broker1",hostname="broker1"} 3 1590969630.500
+gridserver_broker_drivers{name="broker1",hostname="broker1"} 3 1590973200.000
+# HELP gridserver_broker_services_running Number of Services running.
+# TYPE gridserver_broker_services_running gauge
+gridserver_broker_services_running{name="broker1",hostname="broker1"} 5 1590969630.500
+gridserver_broker_services_running{name="broker1",hostname="broker1"} 5 1590973200.000
+# HELP gridserver_broker_tasks_pending Number of tasks pending (not yet assigned to Engines).
+# TYPE gridserver_broker_tasks_pending gauge
+gridserver_broker_tasks_pending{name="broker1",hostname="broker1"} 6 1590969630.500
+gridserver_broker_tasks_pending{name="broker1",hostname="broker1"} 6 1590973200.000
+# HELP gridserver_broker_uptime_minutes Time since Broker start in minutes.
+# TYPE gridserver_broker_uptime_minutes gauge
+gridserver_broker_uptime_minutes{name="broker1",hostname="broker1"} 4 1590969630.500
+gridserver_broker_uptime_minutes{name="broker1",hostname="broker1"} 4 1590973200.000
+# EOF
+`
+	if diff := deep.Equal(out.String(), want); diff != nil {
+		t.Errorf("Backfill() output = %s, want %s", out.String(), want)
+	}
+
+	// The time range is read in chunks, with the last chunk ending at the end of the range.
+	wantArgs := [][]driver.Value{
+		{start, start.Add(time.Hour)},
+		{start.Add(time.Hour), start.Add(90 * time.Minute)},
+	}
+	gotArgs := [][]driver.Value{}
+	for _, q := range fake.Queries() {
+		gotArgs = append(gotArgs, q.args)
+	}
+	if diff := deep.Equal(gotArgs, wantArgs); diff != nil {
+		t.Errorf("Backfill() query arguments: %s", diff)
+	}
+}
+
+func TestSQLClient_BackfillInvalidRange(t *testing.T) {
+	s := newTestSQLClient("postgres", "", "public", time.Second)
+	start := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	if _, _, err := s.Backfill(start, start, time.Hour, false, &bytes.Buffer{}); err == nil {
+		t.Errorf("expected non-nil error")
+	}
+}
+
+func Test_escapeLabelValue(t *testing.T) {
+	if got, want := escapeLabelValue("a\\b\"c\nd"), `a\\b\"c\nd`; got != want {
+		t.Errorf("escapeLabelValue() = %q, want %q", got, want)
+	}
+}
+
+func Test_parseBackfillTime(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{"2020-06-01T12:30:00Z", time.Date(2020, 6, 1, 12, 30, 0, 0, time.UTC), false},
+		{"2020-06-01T12:30:00+10:00", time.Date(2020, 6, 1, 2, 30, 0, 0, time.UTC), false},
+		{"2020-06-01", time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC), false},
+		{"yesterday", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseBackfillTime(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseBackfillTime() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("parseBackfillTime() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// breakerState is the state of a circuit breaker. The values are exported as metrics.
+type breakerState int
+
+const (
+	breakerClosed   breakerState = iota // Calls are allowed
+	breakerOpen                         // Calls are skipped until the cool-down period ends
+	breakerHalfOpen                     // A single trial call is allowed
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// circuitBreaker counts consecutive failures of a Broker, and once the threshold is reached,
+// skips the Broker for a cool-down period. A threshold of zero disables the breaker.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openedAt  time.Time
+	state     breakerState
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// Allow reports whether a call should be attempted at the given time.
+// When the cool-down period of an open breaker has passed, the breaker becomes half-open and one trial call is allowed.
+func (b *circuitBreaker) Allow(now time.Time) bool {
+	if b.threshold <= 0 {
+		return true
+	}
+	if b.state == breakerOpen {
+		if now.Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+	}
+	return true
+}
+
+// Success records a successful call and closes the breaker.
+func (b *circuitBreaker) Success() {
+	b.failures = 0
+	b.state = breakerClosed
+}
+
+// Failure records a failed call at the given time, and opens the breaker if the threshold has been reached
+// or the trial call of a half-open breaker failed.
+func (b *circuitBreaker) Failure(now time.Time) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.state = breakerOpen
+		b.openedAt = now
+	}
+}
+
+// State returns the current state of the breaker.
+func (b *circuitBreaker) State() breakerState {
+	return b.state
+}
+
+// brokerBreakers holds the circuit breakers of the Brokers scraped via the Web Services or REST API, keyed by
+// Broker base URL, and exports their states. Only the breakers of the Brokers in the last scrape are kept.
+type brokerBreakers struct {
+	threshold int
+	cooldown  time.Duration
+	breakers  map[string]*circuitBreaker
+	next      map[string]*circuitBreaker
+	states    *prometheus.GaugeVec
+}
+
+func newBrokerBreakers(threshold int, cooldown time.Duration) *brokerBreakers {
+	return &brokerBreakers{
+		threshold: threshold,
+		cooldown:  cooldown,
+		breakers:  map[string]*circuitBreaker{},
+		states:    newBreakerStateMetric(),
+	}
+}
+
+func newBreakerStateMetric() *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "broker_circuit_breaker_state",
+			Help:      "State of the circuit breaker for per-Broker calls (0 = closed, 1 = open, 2 = half-open).",
+		},
+		[]string{"name", "hostname"},
+	)
+}
+
+// Begin starts a scrape.
+func (b *brokerBreakers) Begin() {
+	b.next = map[string]*circuitBreaker{}
+	b.states.Reset()
+}
+
+// Call collects the per-Broker metrics of a Broker with fetch, unless its breaker is open. A failure does not fail
+// the scrape: the Broker is marked unreachable, without the per-Broker metrics of any calls that succeeded before it.
+func (b *brokerBreakers) Call(broker *BrokerReport, fetch func() error) {
+	breaker, ok := b.breakers[broker.URL]
+	if !ok {
+		breaker = newCircuitBreaker(b.threshold, b.cooldown)
+	}
+	b.next[broker.URL] = breaker
+
+	if breaker.Allow(time.Now()) {
+		if err := fetch(); err != nil {
+			log.WithField("hostname", broker.Hostname).WithField("name", broker.Name).WithField("error", err).Warn("Broker unavailable")
+			breaker.Failure(time.Now())
+			broker.ServicesRunning = -1
+			broker.TasksRunning = -1
+			broker.TasksPending = -1
+			broker.Unreachable = true
+		} else {
+			breaker.Success()
+		}
+	} else {
+		log.WithField("hostname", broker.Hostname).WithField("name", broker.Name).Debug("Broker skipped due to open circuit breaker")
+		broker.Unreachable = true
+	}
+
+	if breaker.State() != breakerClosed {
+		log.WithField("hostname", broker.Hostname).WithField("name", broker.Name).WithField("state", breaker.State()).Warn("Circuit breaker for Broker is not closed")
+	}
+	b.states.WithLabelValues(broker.Name, broker.Hostname).Set(float64(breaker.State()))
+}
+
+// End finishes a scrape, dropping the breakers of the Brokers that were not in it.
+func (b *brokerBreakers) End() {
+	b.breakers = b.next
+	b.next = nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	b := newCircuitBreaker(2, time.Minute)
+
+	if !b.Allow(now) {
+		t.Fatalf("expected new breaker to allow calls")
+	}
+	b.Failure(now)
+	if expect, got := breakerClosed, b.State(); expect != got {
+		t.Errorf("expected %v after 1 failure, got %v", expect, got)
+	}
+	b.Failure(now)
+	if expect, got := breakerOpen, b.State(); expect != got {
+		t.Errorf("expected %v after 2 failures, got %v", expect, got)
+	}
+	if b.Allow(now.Add(30 * time.Second)) {
+		t.Errorf("expected open breaker to skip calls during cool-down")
+	}
+	if !b.Allow(now.Add(time.Minute)) {
+		t.Errorf("expected open breaker to allow a trial call after cool-down")
+	}
+	if expect, got := breakerHalfOpen, b.State(); expect != got {
+		t.Errorf("expected %v after cool-down, got %v", expect, got)
+	}
+	b.Failure(now.Add(time.Minute))
+	if expect, got := breakerOpen, b.State(); expect != got {
+		t.Errorf("expected %v after failed trial call, got %v", expect, got)
+	}
+	if b.Allow(now.Add(90 * time.Second)) {
+		t.Errorf("expected reopened breaker to restart cool-down")
+	}
+	if !b.Allow(now.Add(2 * time.Minute)) {
+		t.Errorf("expected reopened breaker to allow a trial call after cool-down")
+	}
+	b.Success()
+	if expect, got := breakerClosed, b.State(); expect != got {
+		t.Errorf("expected %v after successful trial call, got %v", expect, got)
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	now := time.Now()
+	b := newCircuitBreaker(0, time.Minute)
+	for i := 0; i < 10; i++ {
+		b.Failure(now)
+	}
+	if !b.Allow(now) {
+		t.Errorf("expected disabled breaker to allow calls")
+	}
+	if expect, got := breakerClosed, b.State(); expect != got {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// taskUsage is the Engine time consumed by a completed or failed task.
+type taskUsage struct {
+	End         time.Time
+	User        string // The user who submitted the Service, empty if unknown
+	ServiceType string
+	Seconds     float64
+}
+
+// taskUsageColumns returns the columns of the task events read for the task usage. The user is read from the Service
+// events, as the task events do not record it.
+func taskUsageColumns(d dialect, schema string) string {
+	return fmt.Sprintf(`
+		task_events.time_stamp,
+		(SELECT MAX(job_events.username) FROM %s WHERE job_events.job_id = task_events.job_id),
+		task_events.service_type,
+		task_events.start_time`, d.FromTable(schema, "job_events"))
+}
+
+// taskUsageCondition matches the task events of tasks that consumed Engine time, which includes failed tasks.
+var taskUsageCondition = fmt.Sprintf("UPPER(task_events.event_type) IN ('%s', '%s')", eventCompleted, eventFailed)
+
+// newChargebackQuery returns the query for the task usage from the first argument (inclusive) to the second (exclusive).
+func newChargebackQuery(d dialect, schema string) string {
+	return compact(fmt.Sprintf(`
+		SELECT %s
+		FROM %s
+		WHERE task_events.time_stamp >= %s AND task_events.time_stamp < %s AND %s`,
+		taskUsageColumns(d, schema), d.FromTable(schema, "task_events"), d.Placeholder(1), d.Placeholder(2), taskUsageCondition))
+}
+
+// scanTaskUsage scans a row with the task usage columns. A task without a valid start time consumed no Engine time.
+func scanTaskUsage(rows *sql.Rows) (taskUsage, error) {
+	var u taskUsage
+	var user, serviceType sql.NullString
+	var start sql.NullTime
+	if err := rows.Scan(&u.End, &user, &serviceType, &start); err != nil {
+		return u, err
+	}
+	u.User = user.String
+	u.ServiceType = serviceType.String
+	if start.Valid && !u.End.Before(start.Time) {
+		u.Seconds = u.End.Sub(start.Time).Seconds()
+	}
+	return u, nil
+}
+
+// engineSecondsCollector counts the Engine time consumed by tasks in the reporting database, by user and Service type.
+type engineSecondsCollector struct {
+	reader  *eventReader
+	seconds *prometheus.CounterVec
+}
+
+func newEngineSecondsCollector(d dialect, schema string, state *stateFile) *engineSecondsCollector {
+	return &engineSecondsCollector{
+		reader: newEventReader(d, schema, "task_usage", "task_events", taskUsageColumns(d, schema), taskUsageCondition, state),
+		seconds: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "engine_seconds_total",
+				Help:      "Engine time consumed by completed and failed tasks, by the user who submitted the Service.",
+			},
+			[]string{"user", "service_type"},
+		),
+	}
+}
+
+// Read counts the Engine time of the tasks ended since the previous read.
+func (c *engineSecondsCollector) Read(q queryer) error {
+	return c.reader.Read(q, func(rows *sql.Rows) (event, error) {
+		u, err := scanTaskUsage(rows)
+		if err != nil {
+			return event{}, err
+		}
+		return event{time: u.End, key: eventKey(u.User, u.ServiceType, u.Seconds), count: func() {
+			c.seconds.WithLabelValues(u.User, u.ServiceType).Add(u.Seconds)
+		}}, nil
+	})
+}
+
+// Describe implements prometheus.Collector.
+func (c *engineSecondsCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.seconds.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *engineSecondsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.seconds.Collect(ch)
+}
+
+// TaskUsage passes the usage of each task that ended from start (inclusive) to end (exclusive) to a function.
+// The tasks are read one chunk of time at a time, so that the result sets stay small.
+func (s *SQLClient) TaskUsage(start time.Time, end time.Time, chunk time.Duration, fn func(u taskUsage) error) error {
+	return forEachChunk(start, end, chunk, func(from time.Time, to time.Time) error {
+		rows, err := s.query(chargebackQuery, s.queries[chargebackQuery], s.toDatabaseTime(from), s.toDatabaseTime(to))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		count := 0
+		for rows.Next() {
+			u, err := scanTaskUsage(rows.Rows)
+			if err != nil {
+				log.WithField("error", err).Debug("Row scan failed")
+				return errors.Wrap(err, "row scan failed")
+			}
+			if err := fn(u); err != nil {
+				return err
+			}
+			count++
+		}
+		if err := rows.Err(); err != nil {
+			log.WithField("error", err).Debug("Row processing failed")
+			return errors.Wrap(err, "row processing failed")
+		}
+		log.WithField("start", from).WithField("end", to).WithField("tasks", count).Debug("Task usage read")
+		return nil
+	})
+}
+
+// chargebackKey identifies a line of the chargeback report.
+type chargebackKey struct {
+	User        string
+	ServiceType string
+}
+
+// chargebackUsage is the total usage of a line of the chargeback report.
+type chargebackUsage struct {
+	Tasks   int
+	Seconds float64
+}
+
+// chargebackReport totals the task usage by user and Service type.
+type chargebackReport map[chargebackKey]*chargebackUsage
+
+// Add adds the usage of a task to the report.
+func (c chargebackReport) Add(u taskUsage) error {
+	key := chargebackKey{u.User, u.ServiceType}
+	if c[key] == nil {
+		c[key] = &chargebackUsage{}
+	}
+	c[key].Tasks++
+	c[key].Seconds += u.Seconds
+	return nil
+}
+
+// WriteCSV writes the report as CSV with a header, ordered by user and Service type.
+func (c chargebackReport) WriteCSV(w io.Writer) error {
+	keys := make([]chargebackKey, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].User != keys[j].User {
+			return keys[i].User < keys[j].User
+		}
+		return keys[i].ServiceType < keys[j].ServiceType
+	})
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"user", "service_type", "tasks", "engine_seconds", "engine_hours"})
+	for _, key := range keys {
+		usage := c[key]
+		cw.Write([]string{
+			key.User,
+			key.ServiceType,
+			strconv.Itoa(usage.Tasks),
+			strconv.FormatFloat(usage.Seconds, 'f', 3, 64),
+			strconv.FormatFloat(usage.Seconds/3600, 'f', 3, 64),
+		})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return errors.Wrap(err, "output write failed")
+	}
+	return nil
+}
+
+// Chargeback writes the Engine time consumed by the tasks that ended from start (inclusive) to end (exclusive)
+// to w as CSV, by user and Service type. Returns the number of tasks.
+func (s *SQLClient) Chargeback(start time.Time, end time.Time, chunk time.Duration, w io.Writer) (int, error) {
+	if !start.Before(end) {
+		return 0, fmt.Errorf("start %s not before end %s", start, end)
+	}
+	if s.TimeZone == autoTimeZone {
+		if err := s.detectTimeZone(); err != nil {
+			return 0, errors.Wrap(err, "database time zone detection failed")
+		}
+	}
+
+	report := chargebackReport{}
+	if err := s.TaskUsage(start, end, chunk, report.Add); err != nil {
+		return 0, err
+	}
+	if err := report.WriteCSV(w); err != nil {
+		return 0, err
+	}
+	tasks := 0
+	for _, usage := range report {
+		tasks += usage.Tasks
+	}
+	return tasks, nil
+}
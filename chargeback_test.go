@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+func TestEngineSecondsCollector_Read(t *testing.T) {
+	start := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	batches := [][][]driver.Value{
+		{
+			{start.Add(10 * time.Second), "alice", "pricing", start},
+			{start.Add(20 * time.Second), "alice", "pricing", start.Add(15 * time.Second)},
+			{start.Add(20 * time.Second), "bob", "pricing", start.Add(-100 * time.Second)},
+		},
+		{
+			{start.Add(30 * time.Second), nil, "risk", start.Add(28 * time.Second)},
+			{start.Add(40 * time.Second), "bob", "pricing", nil},                         // No start time
+			{start.Add(50 * time.Second), "bob", "pricing", start.Add(60 * time.Second)}, // Start after end
+		},
+	}
+	batch := 0
+	db, fake := newFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		if strings.Contains(query, "MAX(time_stamp)") {
+			return fakeResult{columns: []string{"max"}, rows: [][]driver.Value{{start}}}
+		}
+		rows := batches[batch]
+		batch++
+		return fakeResult{columns: []string{"time_stamp", "username", "service_type", "start_time"}, rows: rows}
+	})
+	s := newTestSQLClient("postgres", "", "public", time.Second)
+	s.db = db
+	c := newEngineSecondsCollector(s.dialect, s.quotedSchema, nil)
+
+	for i := 0; i < 3; i++ {
+		if err := c.Read(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	queries := fake.Queries()
+	if !strings.Contains(queries[1].query, "job_events.job_id = task_events.job_id") {
+		t.Errorf("task usage query does not read the user from the Service events: %s", queries[1].query)
+	}
+	if diff := deep.Equal(queries[2].args, []driver.Value{start.Add(20 * time.Second)}); diff != nil {
+		t.Errorf("query arguments: %s", diff)
+	}
+
+	tests := []struct {
+		labels []string
+		want   float64
+	}{
+		{[]string{"alice", "pricing"}, 15},
+		{[]string{"bob", "pricing"}, 120},
+		{[]string{"", "risk"}, 2},
+	}
+	for _, tt := range tests {
+		if got := readCounter(c.seconds.WithLabelValues(tt.labels...)); got != tt.want {
+			t.Errorf("engine seconds %v = %f, want %f", tt.labels, got, tt.want)
+		}
+	}
+	if expect, got := len(tests), testCollectorCount(c); expect != got {
+		t.Errorf("expected %d engine seconds series, got %d", expect, got)
+	}
+}
+
+func TestSQLClient_Chargeback(t *testing.T) {
+	start := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	db, fake := newFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		from := args[0].(time.Time)
+		return fakeResult{columns: []string{"time_stamp", "username", "service_type", "start_time"}, rows: [][]driver.Value{
+			{from.Add(time.Hour), "bob", "pricing", from},
+			{from.Add(time.Hour), "alice", "risk", from.Add(30 * time.Minute)},
+			{from.Add(time.Hour), "alice, the second", "pricing", from.Add(59*time.Minute + 59500*time.Millisecond)},
+		}}
+	})
+	s := newTestSQLClient("postgres", "", "public", time.Second)
+	s.db = db
+
+	var out bytes.Buffer
+	tasks, err := s.Chargeback(start, start.Add(36*time.Hour), 24*time.Hour, &out)
+	if err != nil {
+		t.Fatalf("Chargeback() error = %v", err)
+	}
+	if tasks != 6 {
+		t.Errorf("Chargeback() = %d tasks, want 6", tasks)
+	}
+
+	want := `user,service_type,tasks,engine_seconds,engine_hours
+alice,risk,2,3600.000,1.000
+"alice, the second",pricing,2,1.000,0.000
+bob,pricing,2,7200.000,2.000
+`
+	if diff := deep.Equal(out.String(), want); diff != nil {
+		t.Errorf("Chargeback() output = %s, want %s", out.String(), want)
+	}
+
+	wantArgs := [][]driver.Value{
+		{start, start.Add(24 * time.Hour)},
+		{start.Add(24 * time.Hour), start.Add(36 * time.Hour)},
+	}
+	gotArgs := [][]driver.Value{}
+	for _, q := range fake.Queries() {
+		gotArgs = append(gotArgs, q.args)
+	}
+	if diff := deep.Equal(gotArgs, wantArgs); diff != nil {
+		t.Errorf("Chargeback() query arguments: %s", diff)
+	}
+}
+
+func TestSQLClient_ChargebackInvalidRange(t *testing.T) {
+	s := newTestSQLClient("postgres", "", "public", time.Second)
+	start := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := s.Chargeback(start, start.Add(-time.Hour), time.Hour, &bytes.Buffer{}); err == nil {
+		t.Errorf("expected non-nil error")
+	}
+}
+
+// TestSQLClient_ChargebackSQLite runs the chargeback query against a SQLite fixture file.
+func TestSQLClient_ChargebackSQLite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chargeback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "reporting.db")
+
+	fixture, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statements := []string{
+		"CREATE TABLE job_events (time_stamp DATETIME, job_id INTEGER, username VARCHAR(255), service_type VARCHAR(255), event_type VARCHAR(32))",
+		"CREATE TABLE task_events (time_stamp DATETIME, job_id INTEGER, service_type VARCHAR(255), event_type VARCHAR(32), start_time DATETIME)",
+		"INSERT INTO job_events VALUES ('2020-06-01 09:00:00', 1, 'alice', 'pricing', 'SUBMITTED')",
+		"INSERT INTO job_events VALUES ('2020-06-01 11:00:00', 1, 'alice', 'pricing', 'COMPLETED')",
+		"INSERT INTO task_events VALUES ('2020-06-01 10:00:00', 1, 'pricing', 'COMPLETED', '2020-06-01 09:30:00')",
+		"INSERT INTO task_events VALUES ('2020-06-01 10:30:00', 1, 'pricing', 'FAILED', '2020-06-01 10:00:00')",
+		"INSERT INTO task_events VALUES ('2020-06-01 10:30:00', 1, 'pricing', 'SUBMITTED', NULL)",
+		"INSERT INTO task_events VALUES ('2020-06-01 10:30:00', 2, 'risk', 'COMPLETED', '2020-06-01 10:29:00')",
+		"INSERT INTO task_events VALUES ('2020-06-02 10:30:00', 1, 'pricing', 'COMPLETED', '2020-06-02 10:00:00')",
+	}
+	for _, statement := range statements {
+		if _, err := fixture.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fixture.Close()
+
+	s, err := NewSQLClient("sqlite://"+path, Credentials{}, "", time.Second, SQLOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	start := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := s.Chargeback(start, start.Add(24*time.Hour), 6*time.Hour, &out); err != nil {
+		t.Fatalf("Chargeback() error = %v", err)
+	}
+	want := `user,service_type,tasks,engine_seconds,engine_hours
+,risk,1,60.000,0.017
+alice,pricing,2,3600.000,1.000
+`
+	if diff := deep.Equal(out.String(), want); diff != nil {
+		t.Errorf("Chargeback() output = %s, want %s", out.String(), want)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Config represents the contents of the optional configuration file.
+type Config struct {
+	Credentials Credentials              `yaml:"credentials"`
+	Queries     []QueryConfig            `yaml:"queries"`
+	Sessions    map[string]SessionConfig `yaml:"sessions"` // By database driver
+	Headers     map[string]string        `yaml:"headers"`  // Extra HTTP headers, by name
+}
+
+// LoadConfig reads and parses a YAML configuration file. Unknown keys are rejected to catch typos.
+func LoadConfig(path string) (*Config, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "config file read failed")
+	}
+	cfg := &Config{}
+	err = yaml.UnmarshalStrict(content, cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "config file parse failed")
+	}
+	if err := ValidateQueries(cfg.Queries); err != nil {
+		return nil, errors.Wrap(err, "invalid config file")
+	}
+	for driver, s := range cfg.Sessions {
+		if err := s.Validate(driver); err != nil {
+			return nil, errors.Wrap(err, "invalid config file")
+		}
+	}
+	for name := range cfg.Headers {
+		if err := ValidateHeaderName(name); err != nil {
+			return nil, errors.Wrap(err, "invalid config file")
+		}
+	}
+	return cfg, nil
+}
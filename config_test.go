@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		content string
+		want    *Config
+		wantErr bool
+	}{
+		{"Credentials",
+			"credentials:\n  username: user\n  password_file: /run/secrets/password\n",
+			&Config{Credentials: Credentials{Username: "user", PasswordFile: "/run/secrets/password"}},
+			false,
+		},
+		{"Queries",
+			"queries:\n  - name: engines\n    sql: SELECT COUNT(*) AS engines FROM {{schema}}.engines\n    timeout: 5s\n    values:\n      - column: engines\n",
+			&Config{Queries: []QueryConfig{{Name: "engines", SQL: "SELECT COUNT(*) AS engines FROM {{schema}}.engines", Timeout: 5 * time.Second, Values: []QueryValue{{Column: "engines"}}}}},
+			false,
+		},
+		{"InvalidQuery", "queries:\n  - name: engines\n    sql: SELECT 1\n", nil, true},
+		{"DuplicateQuery",
+			"queries:\n  - name: one\n    sql: SELECT 1 AS one\n    values: [{column: one}]\n  - name: one\n    sql: SELECT 1 AS one\n    values: [{column: one}]\n",
+			nil,
+			true,
+		},
+		{"DuplicateMetric",
+			"queries:\n  - name: one\n    sql: SELECT 1 AS one\n    values: [{column: one, metric: ones}]\n  - name: two\n    sql: SELECT 1 AS one\n    values: [{column: one, metric: ones}]\n",
+			nil,
+			true,
+		},
+		{"Sessions",
+			"sessions:\n  sqlserver:\n    isolation: snapshot\n  mysql:\n    statements:\n      - SET SESSION max_statement_time = {{timeout_seconds}}\n",
+			&Config{Sessions: map[string]SessionConfig{
+				"sqlserver": {Isolation: "snapshot"},
+				"mysql":     {Statements: []string{"SET SESSION max_statement_time = {{timeout_seconds}}"}},
+			}},
+			false,
+		},
+		{"InvalidSession", "sessions:\n  postgres:\n    isolation: dirty\n", nil, true},
+		{"Headers",
+			"headers:\n  X-Auth-Token: secret\n",
+			&Config{Headers: map[string]string{"X-Auth-Token": "secret"}},
+			false,
+		},
+		{"ReservedHeader", "headers:\n  authorization: Bearer secret\n", nil, true},
+		{"Empty", "", &Config{}, false},
+		{"UnknownKey", "credentials:\n  user: user\n", nil, true},
+		{"Invalid", "credentials: [", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name+".yml")
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := LoadConfig(path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("LoadConfig() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if diff := deep.Equal(got, tt.want); diff != nil {
+				t.Errorf("LoadConfig() = %v, want %v", got, tt.want)
+				t.Errorf("Difference: %s", diff)
+			}
+		})
+	}
+
+	if _, err := LoadConfig(filepath.Join(dir, "missing.yml")); err == nil {
+		t.Errorf("LoadConfig() missing file: expected non-nil error")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Credentials holds a username and password supplied separately from the data source URL,
+// so that they do not appear in process listings or the environment.
+type Credentials struct {
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"password_file"`
+}
+
+// Resolve returns the username and password to use for a data source. The separately supplied
+// credentials take precedence over any in the URL, and a password file takes precedence over a password.
+// If a password file is used, it is also returned so that the password can be re-read when it changes.
+func (c Credentials) Resolve(user *url.Userinfo) (string, string, *passwordFile, error) {
+	username := user.Username()
+	password, set := user.Password()
+	if len(c.Username) > 0 {
+		username = c.Username
+	}
+	var file *passwordFile
+	if len(c.PasswordFile) > 0 {
+		file = newPasswordFile(c.PasswordFile)
+		var err error
+		password, _, err = file.Read()
+		if err != nil {
+			return "", "", nil, err
+		}
+		set = true
+	} else if len(c.Password) > 0 {
+		password = c.Password
+		set = true
+	}
+	if len(username) == 0 {
+		return "", "", nil, fmt.Errorf("username not set")
+	}
+	if !set {
+		return "", "", nil, fmt.Errorf("password not set")
+	}
+	return username, password, file, nil
+}
+
+// passwordFile reads a password from a file, and re-reads it whenever the file is modified.
+type passwordFile struct {
+	path     string
+	mutex    sync.Mutex
+	modTime  time.Time
+	size     int64
+	password string
+}
+
+func newPasswordFile(path string) *passwordFile {
+	return &passwordFile{path: path}
+}
+
+// Read returns the password, and whether it has changed since the previous call.
+// Trailing line breaks are removed from the file contents.
+func (p *passwordFile) Read() (string, bool, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return "", false, errors.Wrap(err, "password file read failed")
+	}
+	if info.ModTime().Equal(p.modTime) && info.Size() == p.size {
+		return p.password, false, nil
+	}
+
+	content, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return "", false, errors.Wrap(err, "password file read failed")
+	}
+	password := strings.TrimRight(string(content), "\r\n")
+	changed := !p.modTime.IsZero() && password != p.password
+	p.modTime = info.ModTime()
+	p.size = info.Size()
+	p.password = password
+	return password, changed, nil
+}
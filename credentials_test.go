@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writePasswordFile(t *testing.T, dir, password string) string {
+	path := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(path, []byte(password), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCredentials_Resolve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writePasswordFile(t, dir, "filepass\n")
+
+	tests := []struct {
+		name         string
+		creds        Credentials
+		user         *url.Userinfo
+		wantUsername string
+		wantPassword string
+		wantFile     bool
+		wantErr      bool
+	}{
+		{"URL", Credentials{}, url.UserPassword("user", "pass"), "user", "pass", false, false},
+		{"BlankPassword", Credentials{}, url.UserPassword("user", ""), "user", "", false, false},
+		{"Username", Credentials{Username: "flaguser"}, url.UserPassword("user", "pass"), "flaguser", "pass", false, false},
+		{"Password", Credentials{Password: "flagpass"}, url.UserPassword("user", "pass"), "user", "flagpass", false, false},
+		{"PasswordFile", Credentials{Username: "flaguser", PasswordFile: path}, nil, "flaguser", "filepass", true, false},
+		{"PasswordFileOverPassword", Credentials{Password: "flagpass", PasswordFile: path}, url.User("user"), "user", "filepass", true, false},
+		{"MissingPasswordFile", Credentials{PasswordFile: filepath.Join(dir, "missing")}, url.User("user"), "", "", false, true},
+		{"NoUsername", Credentials{Password: "flagpass"}, nil, "", "", false, true},
+		{"NoPassword", Credentials{}, url.User("user"), "", "", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			username, password, file, err := tt.creds.Resolve(tt.user)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Credentials.Resolve() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if username != tt.wantUsername || password != tt.wantPassword {
+				t.Errorf("Credentials.Resolve() = %q, %q, want %q, %q", username, password, tt.wantUsername, tt.wantPassword)
+			}
+			if (file != nil) != tt.wantFile {
+				t.Errorf("Credentials.Resolve() file = %v, wantFile %v", file, tt.wantFile)
+			}
+		})
+	}
+}
+
+func TestPasswordFile_Read(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writePasswordFile(t, dir, "first\r\n")
+
+	p := newPasswordFile(path)
+	password, changed, err := p.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password != "first" || changed {
+		t.Errorf("Read() = %q, %v, want %q, false", password, changed, "first")
+	}
+
+	password, changed, err = p.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password != "first" || changed {
+		t.Errorf("Read() unmodified = %q, %v, want %q, false", password, changed, "first")
+	}
+
+	// Rotate the password, making sure the modification time differs on coarse-grained filesystems.
+	writePasswordFile(t, dir, "second")
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	password, changed, err = p.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password != "second" || !changed {
+		t.Errorf("Read() rotated = %q, %v, want %q, true", password, changed, "second")
+	}
+
+	os.Remove(path)
+	if _, _, err := p.Read(); err == nil {
+		t.Errorf("Read() removed: expected non-nil error")
+	}
+}
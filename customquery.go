@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// metricNameRegexp matches the names that are valid in Prometheus metric and label names.
+var metricNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// reservedMetricPrefixes are the prefixes of built-in metric names, without the namespace.
+// The grid and Broker report metrics are named after the report fields.
+var reservedMetricPrefixes = []string{"grid_", "broker_", "exporter_", "reporting_table_"}
+
+// reservedMetricNames are the other built-in metric names, without the namespace.
+var reservedMetricNames = map[string]bool{
+	"up":                                  true,
+	"engine_events_total":                 true,
+	"engine_seconds_total":                true,
+	"services_completed_total":            true,
+	"services_failed_total":               true,
+	"services_submitted_total":            true,
+	"service_queue_wait_seconds":          true,
+	"tasks_completed_total":               true,
+	"task_duration_seconds":               true,
+	"driver_logins_total":                 true,
+	"driver_last_login_timestamp_seconds": true,
+}
+
+// QueryConfig is a user-defined reporting database query, with the columns that become
+// metric labels and values.
+type QueryConfig struct {
+	Name    string        `yaml:"name"`
+	Help    string        `yaml:"help"`
+	SQL     string        `yaml:"sql"`     // {{schema}} is replaced by the quoted schema name
+	Timeout time.Duration `yaml:"timeout"` // Defaults to the exporter timeout
+	Labels  []string      `yaml:"labels"`
+	Values  []QueryValue  `yaml:"values"`
+}
+
+// QueryValue is a column of a user-defined query that becomes a metric value.
+type QueryValue struct {
+	Column string `yaml:"column"`
+	Metric string `yaml:"metric"` // Defaults to the query name and column name joined by an underscore
+	Type   string `yaml:"type"`   // gauge (the default) or counter
+	Help   string `yaml:"help"`
+}
+
+// Validate checks that a query can be mapped to metrics.
+func (q QueryConfig) Validate() error {
+	if !metricNameRegexp.MatchString(q.Name) {
+		return fmt.Errorf("invalid query name: %q", q.Name)
+	}
+	if len(strings.TrimSpace(q.SQL)) == 0 {
+		return fmt.Errorf("query %q: sql not set", q.Name)
+	}
+	if len(q.Values) == 0 {
+		return fmt.Errorf("query %q: values not set", q.Name)
+	}
+	columns := map[string]bool{}
+	metrics := map[string]bool{}
+	for _, label := range q.Labels {
+		if !metricNameRegexp.MatchString(label) {
+			return fmt.Errorf("query %q: invalid label column: %q", q.Name, label)
+		}
+		if columns[strings.ToLower(label)] {
+			return fmt.Errorf("query %q: duplicate column: %q", q.Name, label)
+		}
+		columns[strings.ToLower(label)] = true
+	}
+	for _, value := range q.Values {
+		if !metricNameRegexp.MatchString(value.Column) {
+			return fmt.Errorf("query %q: invalid value column: %q", q.Name, value.Column)
+		}
+		if columns[strings.ToLower(value.Column)] {
+			return fmt.Errorf("query %q: duplicate column: %q", q.Name, value.Column)
+		}
+		columns[strings.ToLower(value.Column)] = true
+		if len(value.Metric) > 0 && !metricNameRegexp.MatchString(value.Metric) {
+			return fmt.Errorf("query %q: invalid metric name: %q", q.Name, value.Metric)
+		}
+		name := q.metricName(value)
+		if metrics[name] {
+			return fmt.Errorf("query %q: duplicate metric name: %q", q.Name, name)
+		}
+		metrics[name] = true
+		if err := validateMetricName(name); err != nil {
+			return fmt.Errorf("query %q: %v", q.Name, err)
+		}
+		switch value.Type {
+		case "", "gauge", "counter":
+		default:
+			return fmt.Errorf("query %q: invalid metric type: %q", q.Name, value.Type)
+		}
+	}
+	return nil
+}
+
+// metricName returns the fully-qualified name of the metric for a value column.
+func (q QueryConfig) metricName(value QueryValue) string {
+	name := value.Metric
+	if len(name) == 0 {
+		name = q.Name + "_" + strings.ToLower(value.Column)
+	}
+	return prometheus.BuildFQName(namespace, "", name)
+}
+
+// validateMetricName checks that a fully-qualified metric name is not used by a built-in metric.
+func validateMetricName(name string) error {
+	short := strings.TrimPrefix(name, namespace+"_")
+	if reservedMetricNames[short] {
+		return fmt.Errorf("metric name is reserved: %q", name)
+	}
+	for _, prefix := range reservedMetricPrefixes {
+		if strings.HasPrefix(short, prefix) {
+			return fmt.Errorf("metric name is reserved: %q", name)
+		}
+	}
+	return nil
+}
+
+// ValidateQueries checks each query, and that the query and metric names are not repeated across queries.
+func ValidateQueries(queries []QueryConfig) error {
+	names := map[string]bool{}
+	metrics := map[string]string{}
+	for _, q := range queries {
+		if err := q.Validate(); err != nil {
+			return err
+		}
+		if names[q.Name] {
+			return fmt.Errorf("duplicate query name: %q", q.Name)
+		}
+		names[q.Name] = true
+		for _, value := range q.Values {
+			name := q.metricName(value)
+			if other, ok := metrics[name]; ok && other != q.Name {
+				return fmt.Errorf("query %q: metric name %q is also used by query %q", q.Name, name, other)
+			}
+			metrics[name] = q.Name
+		}
+	}
+	return nil
+}
+
+// customQuery runs a user-defined query, and exports the results of the most recent run.
+type customQuery struct {
+	config     QueryConfig
+	sql        string
+	descs      []*prometheus.Desc
+	valueTypes []prometheus.ValueType
+	mutex      sync.Mutex
+	metrics    []prometheus.Metric
+}
+
+func newCustomQuery(config QueryConfig, schema string) *customQuery {
+	q := &customQuery{
+		config: config,
+		sql:    strings.Replace(config.SQL, "{{schema}}", schema, -1),
+	}
+	for _, value := range config.Values {
+		help := value.Help
+		if len(help) == 0 {
+			help = config.Help
+		}
+		if len(help) == 0 {
+			help = fmt.Sprintf("Column %s of user-defined query %s.", value.Column, config.Name)
+		}
+		q.descs = append(q.descs, prometheus.NewDesc(config.metricName(value), help, config.Labels, nil))
+		if value.Type == "counter" {
+			q.valueTypes = append(q.valueTypes, prometheus.CounterValue)
+		} else {
+			q.valueTypes = append(q.valueTypes, prometheus.GaugeValue)
+		}
+	}
+	return q
+}
+
+// Run executes the query and replaces the exported results. If it fails, no results are exported.
+// A timeout of 0 or less means no limit. Rows with the same labels fail the query, as their
+// metrics would conflict.
+func (q *customQuery) Run(s *SQLClient, timeout time.Duration) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.metrics = nil
+
+	if q.config.Timeout > 0 {
+		timeout = q.config.Timeout
+	}
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	rows, err := s.queryContext(ctx, "custom_"+q.config.Name, q.sql)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	// Find the label and value columns by name. Oracle returns upper case column names.
+	columns, err := rows.Columns()
+	if err != nil {
+		return errors.Wrap(err, "column names read failed")
+	}
+	index := map[string]int{}
+	for i, column := range columns {
+		index[strings.ToLower(column)] = i
+	}
+	labelIndexes := make([]int, len(q.config.Labels))
+	for i, label := range q.config.Labels {
+		j, ok := index[strings.ToLower(label)]
+		if !ok {
+			return fmt.Errorf("label column not found: %q", label)
+		}
+		labelIndexes[i] = j
+	}
+	valueIndexes := make([]int, len(q.config.Values))
+	for i, value := range q.config.Values {
+		j, ok := index[strings.ToLower(value.Column)]
+		if !ok {
+			return fmt.Errorf("value column not found: %q", value.Column)
+		}
+		valueIndexes[i] = j
+	}
+
+	metrics := []prometheus.Metric{}
+	seen := map[string]bool{}
+	for rows.Next() {
+		row := make([]sql.NullString, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range row {
+			dest[i] = &row[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			log.WithField("error", err).Debug("Row scan failed")
+			return errors.Wrap(err, "row scan failed")
+		}
+
+		labels := make([]string, len(labelIndexes))
+		for i, j := range labelIndexes {
+			labels[i] = row[j].String
+		}
+		key := strings.Join(labels, "\x1f")
+		if seen[key] {
+			return fmt.Errorf("duplicate label values: %q", labels)
+		}
+		seen[key] = true
+		for i, j := range valueIndexes {
+			if !row[j].Valid {
+				continue // NULL values are not exported
+			}
+			value, err := strconv.ParseFloat(strings.TrimSpace(row[j].String), 64)
+			if err != nil {
+				return fmt.Errorf("value column %q is not numeric: %q", q.config.Values[i].Column, row[j].String)
+			}
+			metric, err := prometheus.NewConstMetric(q.descs[i], q.valueTypes[i], value, labels...)
+			if err != nil {
+				return err
+			}
+			metrics = append(metrics, metric)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.WithField("error", err).Debug("Row processing failed")
+		return errors.Wrap(err, "row processing failed")
+	}
+	q.metrics = metrics
+	return nil
+}
+
+// Describe implements prometheus.Collector.
+func (q *customQuery) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range q.descs {
+		ch <- desc
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (q *customQuery) Collect(ch chan<- prometheus.Metric) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, metric := range q.metrics {
+		ch <- metric
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestQueryConfig_Validate(t *testing.T) {
+	valid := QueryConfig{Name: "engines", SQL: "SELECT os, COUNT(*) AS engines FROM {{schema}}.engines GROUP BY os", Labels: []string{"os"}, Values: []QueryValue{{Column: "engines"}}}
+	tests := []struct {
+		name    string
+		modify  func(q *QueryConfig)
+		wantErr bool
+	}{
+		{"Valid", func(q *QueryConfig) {}, false},
+		{"Counter", func(q *QueryConfig) {
+			q.Values = []QueryValue{{Column: "engines", Type: "counter", Metric: "engine_logins_total"}}
+		}, false},
+		{"InvalidName", func(q *QueryConfig) { q.Name = "engine-count" }, true},
+		{"NoSQL", func(q *QueryConfig) { q.SQL = " " }, true},
+		{"NoValues", func(q *QueryConfig) { q.Values = nil }, true},
+		{"InvalidLabel", func(q *QueryConfig) { q.Labels = []string{"os name"} }, true},
+		{"DuplicateColumn", func(q *QueryConfig) { q.Labels = []string{"ENGINES"} }, true},
+		{"InvalidMetric", func(q *QueryConfig) { q.Values = []QueryValue{{Column: "engines", Metric: "1engines"}} }, true},
+		{"InvalidType", func(q *QueryConfig) { q.Values = []QueryValue{{Column: "engines", Type: "histogram"}} }, true},
+		{"DuplicateMetric", func(q *QueryConfig) {
+			q.Values = []QueryValue{{Column: "engines", Metric: "engines"}, {Column: "logins", Metric: "engines"}}
+		}, true},
+		{"ReservedMetric", func(q *QueryConfig) { q.Values = []QueryValue{{Column: "engines", Metric: "up"}} }, true},
+		{"ReservedPrefix", func(q *QueryConfig) { q.Values = []QueryValue{{Column: "engines", Metric: "broker_engines"}} }, true},
+		{"ReservedQueryName", func(q *QueryConfig) { q.Name = "grid" }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := valid
+			tt.modify(&q)
+			if err := q.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateQueries(t *testing.T) {
+	engines := QueryConfig{Name: "engines", SQL: "SELECT COUNT(*) AS engines FROM {{schema}}.engines", Values: []QueryValue{{Column: "engines"}}}
+	tests := []struct {
+		name    string
+		queries []QueryConfig
+		wantErr bool
+	}{
+		{"None", nil, false},
+		{"Valid", []QueryConfig{engines, {Name: "brokers", SQL: "SELECT 1 AS brokers", Values: []QueryValue{{Column: "brokers"}}}}, false},
+		{"Invalid", []QueryConfig{engines, {Name: "brokers", SQL: "SELECT 1 AS brokers"}}, true},
+		{"DuplicateName", []QueryConfig{engines, engines}, true},
+		{"DuplicateMetric", []QueryConfig{engines, {Name: "engine", SQL: "SELECT 1 AS engines", Values: []QueryValue{{Column: "engines", Metric: "engines_engines"}}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateQueries(tt.queries); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateQueries() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCustomQuery_Run(t *testing.T) {
+	config := QueryConfig{
+		Name:   "engines",
+		SQL:    "SELECT os, COUNT(*) AS engines, SUM(logins) AS logins FROM {{schema}}.engines GROUP BY os",
+		Labels: []string{"os"},
+		Values: []QueryValue{{Column: "engines"}, {Column: "logins", Type: "counter", Metric: "engine_logins_total"}},
+	}
+	tests := []struct {
+		name    string
+		result  fakeResult
+		want    []string
+		wantErr bool
+	}{
+		{"Rows",
+			fakeResult{columns: []string{"OS", "ENGINES", "LOGINS"}, rows: [][]driver.Value{
+				{"linux", int64(10), 100.5},
+				{"windows", int64(5), nil},
+			}},
+			[]string{
+				`gridserver_engines_engines{os="linux"} gauge 10`,
+				`gridserver_engine_logins_total{os="linux"} counter 100.5`,
+				`gridserver_engines_engines{os="windows"} gauge 5`,
+			},
+			false,
+		},
+		{"MissingColumn", fakeResult{columns: []string{"os", "engines"}}, nil, true},
+		{"DuplicateLabels",
+			fakeResult{columns: []string{"os", "engines", "logins"}, rows: [][]driver.Value{
+				{"linux", int64(10), int64(1)},
+				{"linux", int64(5), int64(2)},
+			}},
+			nil,
+			true,
+		},
+		{"NotNumeric",
+			fakeResult{columns: []string{"os", "engines", "logins"}, rows: [][]driver.Value{{"linux", "ten", int64(1)}}},
+			nil,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var query string
+			db, _ := newFakeDB(t, func(q string, args []driver.Value) fakeResult {
+				query = q
+				return tt.result
+			})
+			s := newTestSQLClient("postgres", "", "public", time.Second)
+			s.db = db
+			q := newCustomQuery(config, s.quotedSchema)
+
+			err := q.Run(s, time.Second)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Run() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if expect := `SELECT os, COUNT(*) AS engines, SUM(logins) AS logins FROM "public".engines GROUP BY os`; query != expect {
+				t.Errorf("expected query %q, got %q", expect, query)
+			}
+
+			got := []string{}
+			ch := make(chan prometheus.Metric)
+			go func() {
+				q.Collect(ch)
+				close(ch)
+			}()
+			for m := range ch {
+				got = append(got, describeMetric(t, m))
+			}
+			if tt.want == nil {
+				tt.want = []string{}
+			}
+			if diff := deep.Equal(got, tt.want); diff != nil {
+				t.Errorf("Collect() = %v, want %v", got, tt.want)
+				t.Errorf("Difference: %s", diff)
+			}
+		})
+	}
+}
+
+func TestCustomQuery_RunNoTimeout(t *testing.T) {
+	db, _ := newFakeDB(t, func(q string, args []driver.Value) fakeResult {
+		return fakeResult{columns: []string{"engines"}, rows: [][]driver.Value{{int64(3)}}}
+	})
+	s := newTestSQLClient("postgres", "", "public", 0)
+	s.db = db
+	q := newCustomQuery(QueryConfig{Name: "engines", SQL: "SELECT COUNT(*) AS engines", Values: []QueryValue{{Column: "engines"}}}, s.quotedSchema)
+	if err := q.Run(s, 0); err != nil {
+		t.Errorf("Run() with no timeout: unexpected error: %v", err)
+	}
+}
+
+// describeMetric returns a metric name, labels, type and value in a form that is easy to compare.
+func describeMetric(t *testing.T, m prometheus.Metric) string {
+	pb := &dto.Metric{}
+	if err := m.Write(pb); err != nil {
+		t.Fatal(err)
+	}
+	name := strings.SplitN(m.Desc().String(), `"`, 3)[1] // Desc{fqName: "name", ...}
+	labels := []string{}
+	for _, label := range pb.GetLabel() {
+		labels = append(labels, fmt.Sprintf("%s=%q", label.GetName(), label.GetValue()))
+	}
+	if pb.Counter != nil {
+		return fmt.Sprintf("%s{%s} counter %v", name, strings.Join(labels, ","), pb.GetCounter().GetValue())
+	}
+	return fmt.Sprintf("%s{%s} gauge %v", name, strings.Join(labels, ","), pb.GetGauge().GetValue())
+}
+
+func TestSQLClient_RunCustomQueries(t *testing.T) {
+	db, _ := newFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		if strings.Contains(query, "broken") {
+			return fakeResult{err: fmt.Errorf("table not found")}
+		}
+		if strings.Contains(query, "COUNT(*)") {
+			return fakeResult{columns: []string{"engines"}, rows: [][]driver.Value{{int64(3)}}}
+		}
+		return fakeResult{columns: latestColumns, rows: [][]driver.Value{latestRow(1, time.Now())}}
+	})
+	s := newTestSQLClient("postgres", "", "public", time.Second)
+	s.db = db
+	s.customSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "success"}, []string{"query"})
+	for _, config := range []QueryConfig{
+		{Name: "broken", SQL: "SELECT broken FROM {{schema}}.broken", Values: []QueryValue{{Column: "broken"}}},
+		{Name: "engines", SQL: "SELECT COUNT(*) AS engines FROM {{schema}}.engines", Values: []QueryValue{{Column: "engines"}}},
+	} {
+		s.customQueries = append(s.customQueries, newCustomQuery(config, s.quotedSchema))
+	}
+
+	_, brokers, err := s.Fetch()()
+	if err != nil {
+		t.Fatalf("expected a failed user-defined query not to fail the scrape, got %v", err)
+	}
+	if len(brokers) != 1 {
+		t.Errorf("expected 1 Broker, got %d", len(brokers))
+	}
+	if expect, got := 0., readGauge(s.customSuccess.WithLabelValues("broken")); expect != got {
+		t.Errorf("expected broken query success %f, got %f", expect, got)
+	}
+	if expect, got := 1., readGauge(s.customSuccess.WithLabelValues("engines")); expect != got {
+		t.Errorf("expected engines query success %f, got %f", expect, got)
+	}
+	if expect, got := 1, testCollectorCount(s.customQueries[1]); expect != got {
+		t.Errorf("expected %d engines metrics, got %d", expect, got)
+	}
+}
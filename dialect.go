@@ -0,0 +1,523 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// identifierRegexp matches the unquoted identifiers accepted by all of the supported databases.
+var identifierRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$]*$`)
+
+// dialect encapsulates the differences in SQL syntax between the supported reporting databases.
+type dialect interface {
+	// QuoteIdentifier validates an identifier (e.g. a schema name) and returns it quoted for use in a query.
+	// The identifier is case folded in the same way as the database folds unquoted identifiers.
+	QuoteIdentifier(name string) (string, error)
+	// Placeholder returns the bind parameter placeholder for the nth (starting at 1) query argument.
+	Placeholder(n int) string
+	// FromTable returns a table in the quoted schema for a FROM clause, aliased to the table name.
+	FromTable(schema string, table string) string
+	// FromTableAs returns a table in the quoted schema for a FROM clause, aliased to a different name, so that a
+	// subquery can refer to the same table as the outer query.
+	FromTableAs(schema string, table string, alias string) string
+	// Limit returns the clause appended to an ordered query to return only its first n rows.
+	Limit(n int) string
+	// BrokerIDsQuery returns the query for the IDs of all Brokers, in the quoted schema.
+	BrokerIDsQuery(schema string) string
+	// LatestQuery returns the query for the most recent report of each Broker, in the quoted schema.
+	// The columns are the Broker ID, URL and name, the busy engines, total engines, drivers, uptime,
+	// running services, pending tasks, and the report timestamp. If the condition is not empty,
+	// only the broker_stats rows that match it are considered. It may refer to the broker_stats columns.
+	LatestQuery(schema string, condition string) string
+	// TimeZoneOffsetQuery returns the query for the current offset of the database server time zone from UTC, in seconds.
+	TimeZoneOffsetQuery() string
+	// TxOptions returns the options of the read-only transactions, with an isolation level that does not block inserts.
+	TxOptions() sql.TxOptions
+	// SessionStatements returns the statements run at the start of each read-only transaction, which limit the
+	// statement and lock wait times. They may contain the statement timeout placeholders.
+	SessionStatements() []string
+	// SessionResetStatements returns the statements run at the end of each read-only transaction, before it is rolled
+	// back, which reset the session statement settings that would otherwise persist on the pooled connection.
+	SessionResetStatements() []string
+	// PlanQuery returns the query for the plan of a query, and whether it explains the query. A query that explains
+	// the plan is run with the arguments of the query and returns a description of the plan, otherwise it is run
+	// without arguments and returns the plan hash of the most recent run of the query, if it is cached.
+	PlanQuery(query string) (string, bool)
+}
+
+// dialectFor returns the dialect for a database driver. The MariaDB dialect is chosen by the URL scheme instead,
+// as MySQL and MariaDB share a driver.
+func dialectFor(driver string) (dialect, error) {
+	switch driver {
+	case "postgres":
+		return postgresDialect{}, nil
+	case "sqlserver":
+		return sqlserverDialect{}, nil
+	case "godror":
+		return oracleDialect{}, nil
+	case "mysql":
+		return mysqlDialect{}, nil
+	case "sqlite3":
+		return sqliteDialect{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported driver: %q", driver)
+	}
+}
+
+// clause returns the condition prefixed by a keyword (e.g. WHERE or AND), or an empty string if there is no condition.
+func clause(keyword string, condition string) string {
+	if len(condition) == 0 {
+		return ""
+	}
+	return keyword + " " + condition
+}
+
+// placeholders returns a comma-separated list of count placeholders, starting at the nth.
+func placeholders(d dialect, n int, count int) string {
+	list := make([]string, count)
+	for i := range list {
+		list[i] = d.Placeholder(n + i)
+	}
+	return strings.Join(list, ", ")
+}
+
+// validateIdentifier checks that an identifier does not need quoting, so that it can never
+// contain quote characters, and is within the maximum length for the database.
+func validateIdentifier(name string, maxLength int) error {
+	if len(name) == 0 {
+		return fmt.Errorf("identifier not set")
+	}
+	if len(name) > maxLength {
+		return fmt.Errorf("identifier longer than %d characters: %q", maxLength, name)
+	}
+	if !identifierRegexp.MatchString(name) {
+		return fmt.Errorf("invalid identifier: %q", name)
+	}
+	return nil
+}
+
+// postgresDialect is the dialect for PostgreSQL, which folds unquoted identifiers to lower case.
+type postgresDialect struct{}
+
+func (postgresDialect) QuoteIdentifier(name string) (string, error) {
+	if err := validateIdentifier(name, 63); err != nil {
+		return "", err
+	}
+	return `"` + strings.ToLower(name) + `"`, nil
+}
+
+func (postgresDialect) Placeholder(n int) string {
+	return fmt.Sprintf("$%d", n)
+}
+
+func (d postgresDialect) FromTable(schema string, table string) string {
+	return d.FromTableAs(schema, table, table)
+}
+
+func (postgresDialect) FromTableAs(schema string, table string, alias string) string {
+	return fmt.Sprintf("%s.%s %s", schema, table, alias)
+}
+
+func (postgresDialect) Limit(n int) string {
+	return fmt.Sprintf("LIMIT %d", n)
+}
+
+func (postgresDialect) TimeZoneOffsetQuery() string {
+	return "SELECT CAST(EXTRACT(TIMEZONE FROM CURRENT_TIMESTAMP) AS INTEGER)"
+}
+
+func (postgresDialect) TxOptions() sql.TxOptions {
+	return sql.TxOptions{Isolation: sql.LevelReadCommitted, ReadOnly: true}
+}
+
+// SessionStatements only set the timeouts for the transaction, so they do not persist on the connection.
+func (postgresDialect) SessionStatements() []string {
+	return []string{
+		"SET LOCAL statement_timeout = " + timeoutMillisPlaceholder,
+		"SET LOCAL lock_timeout = " + timeoutMillisPlaceholder,
+	}
+}
+
+func (postgresDialect) SessionResetStatements() []string {
+	return nil
+}
+
+func (postgresDialect) PlanQuery(query string) (string, bool) {
+	return "EXPLAIN (COSTS OFF) " + query, true
+}
+
+func (postgresDialect) BrokerIDsQuery(schema string) string {
+	return fmt.Sprintf("SELECT broker_id FROM %s.brokers", schema)
+}
+
+func (postgresDialect) LatestQuery(schema string, condition string) string {
+	return fmt.Sprintf(`
+		WITH latest AS (
+			SELECT
+				broker_id,
+				MAX(time_stamp) AS max_time_stamp
+			FROM %[1]s.broker_stats
+			%[2]s
+			GROUP BY broker_id )
+		SELECT
+			latest.broker_id,
+			brokers.broker_url,
+			brokers.broker_name,
+			broker_stats.num_busy_engines,
+			broker_stats.num_total_engines,
+			broker_stats.num_drivers,
+			broker_stats.uptime_minutes,
+			broker_stats.num_jobs_running,
+			broker_stats.num_tasks_pending,
+			latest.max_time_stamp AS time_stamp
+		FROM latest
+		INNER JOIN %[1]s.broker_stats ON broker_stats.broker_id = latest.broker_id
+			AND broker_stats.time_stamp = latest.max_time_stamp
+		INNER JOIN %[1]s.brokers ON brokers.broker_id = latest.broker_id
+		`, schema, clause("WHERE", condition))
+}
+
+// sqlserverDialect is the dialect for SQL Server, where identifier case sensitivity depends on the collation.
+type sqlserverDialect struct{}
+
+func (sqlserverDialect) QuoteIdentifier(name string) (string, error) {
+	if err := validateIdentifier(name, 128); err != nil {
+		return "", err
+	}
+	return "[" + name + "]", nil
+}
+
+func (sqlserverDialect) Placeholder(n int) string {
+	return fmt.Sprintf("@p%d", n)
+}
+
+func (d sqlserverDialect) FromTable(schema string, table string) string {
+	return d.FromTableAs(schema, table, table)
+}
+
+func (sqlserverDialect) FromTableAs(schema string, table string, alias string) string {
+	return fmt.Sprintf("%s.%s AS %s", schema, table, alias)
+}
+
+func (sqlserverDialect) Limit(n int) string {
+	return fmt.Sprintf("OFFSET 0 ROWS FETCH NEXT %d ROWS ONLY", n)
+}
+
+func (sqlserverDialect) TimeZoneOffsetQuery() string {
+	return "SELECT DATEPART(TZOFFSET, SYSDATETIMEOFFSET()) * 60"
+}
+
+// TxOptions reads only committed rows. If the READ_COMMITTED_SNAPSHOT database option is on, the rows are read from
+// row versions without locks, otherwise the short shared locks can wait for GridServer writes, up to the lock timeout.
+// The driver does not support read-only transactions.
+func (sqlserverDialect) TxOptions() sql.TxOptions {
+	return sql.TxOptions{Isolation: sql.LevelReadCommitted}
+}
+
+// SessionStatements limit the lock wait time. SQL Server has no statement timeout, so the query is cancelled by the
+// driver when the context deadline passes.
+func (sqlserverDialect) SessionStatements() []string {
+	return []string{"SET LOCK_TIMEOUT " + timeoutMillisPlaceholder}
+}
+
+func (sqlserverDialect) SessionResetStatements() []string {
+	return nil
+}
+
+// PlanQuery looks up the plan hash in the query statistics, which needs the VIEW SERVER STATE permission, as the
+// SHOWPLAN settings must be set in a batch of their own. The text of a query with arguments is prefixed with the
+// parameter declarations.
+func (sqlserverDialect) PlanQuery(query string) (string, bool) {
+	text := "N'" + strings.Replace(query, "'", "''", -1) + "'"
+	return fmt.Sprintf(`SELECT TOP 1 CONVERT(VARCHAR(18), stats.query_plan_hash, 1)
+		FROM sys.dm_exec_query_stats AS stats CROSS APPLY sys.dm_exec_sql_text(stats.sql_handle) AS sql_text
+		WHERE RIGHT(sql_text.text, LEN(%[1]s)) = %[1]s
+		ORDER BY stats.last_execution_time DESC`, text), false
+}
+
+func (sqlserverDialect) BrokerIDsQuery(schema string) string {
+	return fmt.Sprintf("SELECT broker_id FROM %s.brokers", schema)
+}
+
+func (sqlserverDialect) LatestQuery(schema string, condition string) string {
+	return fmt.Sprintf(`
+		SELECT
+			brokers.broker_id,
+			brokers.broker_url,
+			brokers.broker_name,
+			latest.num_busy_engines,
+			latest.num_total_engines,
+			latest.num_drivers,
+			latest.uptime_minutes,
+			latest.num_jobs_running,
+			latest.num_tasks_pending,
+			latest.time_stamp
+		FROM %[1]s.brokers AS brokers
+		CROSS APPLY (
+			SELECT TOP 1
+				num_busy_engines,
+				num_total_engines,
+				num_drivers,
+				uptime_minutes,
+				num_jobs_running,
+				num_tasks_pending,
+				time_stamp
+			FROM %[1]s.broker_stats AS broker_stats
+			WHERE broker_stats.broker_id = brokers.broker_id
+			%[2]s
+			ORDER BY broker_stats.time_stamp DESC ) AS latest
+		`, schema, clause("AND", condition))
+}
+
+// oracleDialect is the dialect for Oracle, which folds unquoted identifiers to upper case.
+type oracleDialect struct{}
+
+func (oracleDialect) QuoteIdentifier(name string) (string, error) {
+	if err := validateIdentifier(name, 128); err != nil {
+		return "", err
+	}
+	return `"` + strings.ToUpper(name) + `"`, nil
+}
+
+func (oracleDialect) Placeholder(n int) string {
+	return fmt.Sprintf(":%d", n)
+}
+
+func (d oracleDialect) FromTable(schema string, table string) string {
+	return d.FromTableAs(schema, table, table)
+}
+
+func (oracleDialect) FromTableAs(schema string, table string, alias string) string {
+	return fmt.Sprintf("%s.%s %s", schema, table, alias) // Oracle does not allow AS for table aliases
+}
+
+func (oracleDialect) Limit(n int) string {
+	return fmt.Sprintf("FETCH FIRST %d ROWS ONLY", n)
+}
+
+func (oracleDialect) TimeZoneOffsetQuery() string {
+	return "SELECT EXTRACT(TIMEZONE_HOUR FROM SYSTIMESTAMP) * 3600 + EXTRACT(TIMEZONE_MINUTE FROM SYSTIMESTAMP) * 60 FROM DUAL"
+}
+
+// TxOptions uses the default isolation level, as Oracle readers never block writers.
+func (oracleDialect) TxOptions() sql.TxOptions {
+	return sql.TxOptions{ReadOnly: true}
+}
+
+// SessionStatements are empty, as Oracle has no session statement timeout. The driver sets the call timeout
+// from the context deadline instead, and resource limits are set in the profile of the user by the DBA.
+func (oracleDialect) SessionStatements() []string {
+	return nil
+}
+
+func (oracleDialect) SessionResetStatements() []string {
+	return nil
+}
+
+// PlanQuery looks up the plan hash in the shared pool, which needs the SELECT_CATALOG_ROLE role (or SELECT on V$SQL),
+// as EXPLAIN PLAN writes to the plan table. The SQL ID is computed from the query text, which needs Oracle 12c.
+func (oracleDialect) PlanQuery(query string) (string, bool) {
+	return fmt.Sprintf(`SELECT TO_CHAR(plan_hash_value) FROM v$sql
+		WHERE sql_id = DBMS_SQL_TRANSLATOR.SQL_ID('%s')
+		ORDER BY last_active_time DESC FETCH FIRST 1 ROWS ONLY`, strings.Replace(query, "'", "''", -1)), false
+}
+
+func (oracleDialect) BrokerIDsQuery(schema string) string {
+	return fmt.Sprintf("SELECT broker_id FROM %s.brokers", schema)
+}
+
+func (oracleDialect) LatestQuery(schema string, condition string) string {
+	return fmt.Sprintf(`
+		SELECT
+			broker_id,
+			broker_url,
+			broker_name,
+			num_busy_engines,
+			num_total_engines,
+			num_drivers,
+			uptime_minutes,
+			num_jobs_running,
+			num_tasks_pending,
+			time_stamp
+		FROM (
+			SELECT
+				broker_stats.broker_id,
+				brokers.broker_url,
+				brokers.broker_name,
+				broker_stats.num_busy_engines,
+				broker_stats.num_total_engines,
+				broker_stats.num_drivers,
+				broker_stats.uptime_minutes,
+				broker_stats.num_jobs_running,
+				broker_stats.num_tasks_pending,
+				broker_stats.time_stamp,
+				ROW_NUMBER() OVER (PARTITION BY broker_stats.broker_id ORDER BY broker_stats.time_stamp DESC) AS rn
+			FROM %[1]s.broker_stats broker_stats
+			INNER JOIN %[1]s.brokers brokers ON brokers.broker_id = broker_stats.broker_id
+			%[2]s )
+		WHERE rn = 1
+		`, schema, clause("WHERE", condition))
+}
+
+// derivedLatestQuery returns the latest report query using a derived table of the most recent timestamp of each Broker,
+// which works on MySQL 5.7 and SQLite without common table expressions or window functions. The report timestamp is
+// read from broker_stats rather than the derived table, so that SQLite returns it as a timestamp rather than text.
+func derivedLatestQuery(schema string, condition string) string {
+	return fmt.Sprintf(`
+		SELECT
+			latest.broker_id,
+			brokers.broker_url,
+			brokers.broker_name,
+			broker_stats.num_busy_engines,
+			broker_stats.num_total_engines,
+			broker_stats.num_drivers,
+			broker_stats.uptime_minutes,
+			broker_stats.num_jobs_running,
+			broker_stats.num_tasks_pending,
+			broker_stats.time_stamp
+		FROM (
+			SELECT
+				broker_id,
+				MAX(time_stamp) AS max_time_stamp
+			FROM %[1]s.broker_stats AS broker_stats
+			%[2]s
+			GROUP BY broker_id ) AS latest
+		INNER JOIN %[1]s.broker_stats AS broker_stats ON broker_stats.broker_id = latest.broker_id
+			AND broker_stats.time_stamp = latest.max_time_stamp
+		INNER JOIN %[1]s.brokers AS brokers ON brokers.broker_id = latest.broker_id
+		`, schema, clause("WHERE", condition))
+}
+
+// mysqlDialect is the dialect for MySQL, where a schema is a database, and identifier case sensitivity depends on
+// the file system.
+type mysqlDialect struct{}
+
+func (mysqlDialect) QuoteIdentifier(name string) (string, error) {
+	if err := validateIdentifier(name, 64); err != nil {
+		return "", err
+	}
+	return "`" + name + "`", nil
+}
+
+// Placeholder returns the positional placeholder, so the arguments must be referred to in order.
+func (mysqlDialect) Placeholder(n int) string {
+	return "?"
+}
+
+func (d mysqlDialect) FromTable(schema string, table string) string {
+	return d.FromTableAs(schema, table, table)
+}
+
+func (mysqlDialect) FromTableAs(schema string, table string, alias string) string {
+	return fmt.Sprintf("%s.%s AS %s", schema, table, alias)
+}
+
+func (mysqlDialect) Limit(n int) string {
+	return fmt.Sprintf("LIMIT %d", n)
+}
+
+func (mysqlDialect) TimeZoneOffsetQuery() string {
+	return "SELECT TIMESTAMPDIFF(SECOND, UTC_TIMESTAMP(), NOW())"
+}
+
+// TxOptions read the committed rows from a snapshot per statement, without gap locks that would block inserts.
+func (mysqlDialect) TxOptions() sql.TxOptions {
+	return sql.TxOptions{Isolation: sql.LevelReadCommitted, ReadOnly: true}
+}
+
+// SessionStatements limit the SELECT statement time on MySQL 5.7.8 or later. The setting is for the session, as
+// SET STATEMENT is only supported by MySQL 8.0, so it is reset at the end of the transaction.
+func (mysqlDialect) SessionStatements() []string {
+	return []string{"SET SESSION max_execution_time = " + timeoutMillisPlaceholder}
+}
+
+func (mysqlDialect) SessionResetStatements() []string {
+	return []string{"SET SESSION max_execution_time = DEFAULT"}
+}
+
+func (mysqlDialect) PlanQuery(query string) (string, bool) {
+	return "EXPLAIN " + query, true
+}
+
+func (mysqlDialect) BrokerIDsQuery(schema string) string {
+	return fmt.Sprintf("SELECT broker_id FROM %s.brokers", schema)
+}
+
+func (mysqlDialect) LatestQuery(schema string, condition string) string {
+	return derivedLatestQuery(schema, condition)
+}
+
+// mariadbDialect is the dialect for MariaDB, which differs from MySQL only in its statement time limit.
+type mariadbDialect struct {
+	mysqlDialect
+}
+
+// SessionStatements limit the statement time, in seconds. The setting is for the session, as SET STATEMENT cannot be
+// run as a separate statement, so it is reset at the end of the transaction.
+func (mariadbDialect) SessionStatements() []string {
+	return []string{"SET SESSION max_statement_time = " + timeoutSecondsPlaceholder}
+}
+
+func (mariadbDialect) SessionResetStatements() []string {
+	return []string{"SET SESSION max_statement_time = DEFAULT"}
+}
+
+// sqliteDialect is the dialect for SQLite, where a schema is an attached database file ("main" by default),
+// and identifiers are not case sensitive.
+type sqliteDialect struct{}
+
+func (sqliteDialect) QuoteIdentifier(name string) (string, error) {
+	if err := validateIdentifier(name, 128); err != nil {
+		return "", err
+	}
+	return `"` + name + `"`, nil
+}
+
+func (sqliteDialect) Placeholder(n int) string {
+	return fmt.Sprintf("?%d", n)
+}
+
+func (d sqliteDialect) FromTable(schema string, table string) string {
+	return d.FromTableAs(schema, table, table)
+}
+
+func (sqliteDialect) FromTableAs(schema string, table string, alias string) string {
+	return fmt.Sprintf("%s.%s AS %s", schema, table, alias)
+}
+
+func (sqliteDialect) Limit(n int) string {
+	return fmt.Sprintf("LIMIT %d", n)
+}
+
+// TimeZoneOffsetQuery returns the offset of the local time zone of the exporter host, as SQLite runs in the exporter.
+func (sqliteDialect) TimeZoneOffsetQuery() string {
+	return "SELECT CAST(ROUND((julianday('now', 'localtime') - julianday('now')) * 86400) AS INTEGER)"
+}
+
+// TxOptions are ignored by the driver, as the database file is opened read-only by default instead.
+func (sqliteDialect) TxOptions() sql.TxOptions {
+	return sql.TxOptions{ReadOnly: true}
+}
+
+// SessionStatements are empty, as the driver interrupts the query when the context deadline passes.
+func (sqliteDialect) SessionStatements() []string {
+	return nil
+}
+
+func (sqliteDialect) SessionResetStatements() []string {
+	return nil
+}
+
+func (sqliteDialect) PlanQuery(query string) (string, bool) {
+	return "EXPLAIN QUERY PLAN " + query, true
+}
+
+func (sqliteDialect) BrokerIDsQuery(schema string) string {
+	return fmt.Sprintf("SELECT broker_id FROM %s.brokers", schema)
+}
+
+func (sqliteDialect) LatestQuery(schema string, condition string) string {
+	return derivedLatestQuery(schema, condition)
+}
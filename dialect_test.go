@@ -0,0 +1,166 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_dialectFor(t *testing.T) {
+	tests := []struct {
+		driver  string
+		want    dialect
+		wantErr bool
+	}{
+		{"postgres", postgresDialect{}, false},
+		{"sqlserver", sqlserverDialect{}, false},
+		{"godror", oracleDialect{}, false},
+		{"mysql", mysqlDialect{}, false},
+		{"sqlite3", sqliteDialect{}, false},
+		{"odbc", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.driver, func(t *testing.T) {
+			got, err := dialectFor(tt.driver)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("dialectFor() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("dialectFor() = %T, want %T", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_dialect_QuoteIdentifier(t *testing.T) {
+	tests := []struct {
+		name    string
+		dialect dialect
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{"PostgresLower", postgresDialect{}, "public", `"public"`, false},
+		{"PostgresFolded", postgresDialect{}, "Reporting", `"reporting"`, false},
+		{"PostgresTooLong", postgresDialect{}, strings.Repeat("a", 64), "", true},
+		{"SQLServer", sqlserverDialect{}, "dbo", "[dbo]", false},
+		{"SQLServerMixedCase", sqlserverDialect{}, "GridServer", "[GridServer]", false},
+		{"OracleFolded", oracleDialect{}, "gridserver", `"GRIDSERVER"`, false},
+		{"OracleDollar", oracleDialect{}, "grid$server", `"GRID$SERVER"`, false},
+		{"OracleMaxLength", oracleDialect{}, strings.Repeat("a", 128), `"` + strings.Repeat("A", 128) + `"`, false},
+		{"MySQL", mysqlDialect{}, "Reporting", "`Reporting`", false},
+		{"MySQLTooLong", mysqlDialect{}, strings.Repeat("a", 65), "", true},
+		{"SQLite", sqliteDialect{}, "main", `"main"`, false},
+		{"Empty", postgresDialect{}, "", "", true},
+		{"LeadingDigit", postgresDialect{}, "1schema", "", true},
+		{"DoubleQuote", postgresDialect{}, `foo"bar`, "", true},
+		{"Bracket", sqlserverDialect{}, "foo]bar", "", true},
+		{"Dot", oracleDialect{}, "foo.bar", "", true},
+		{"Space", oracleDialect{}, "foo bar", "", true},
+		{"Injection", sqlserverDialect{}, "dbo; DROP TABLE brokers", "", true},
+		{"Backtick", mysqlDialect{}, "foo`bar", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.dialect.QuoteIdentifier(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("QuoteIdentifier(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("QuoteIdentifier(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_dialect_LatestQuery(t *testing.T) {
+	tests := []struct {
+		name     string
+		dialect  dialect
+		contains []string
+	}{
+		{"Postgres", postgresDialect{}, []string{`FROM "schema".broker_stats`, `INNER JOIN "schema".brokers`}},
+		{"SQLServer", sqlserverDialect{}, []string{"TOP 1", "CROSS APPLY", `"schema".broker_stats`}},
+		{"Oracle", oracleDialect{}, []string{"ROW_NUMBER() OVER", `FROM "schema".broker_stats`}},
+		{"MySQL", mysqlDialect{}, []string{"MAX(time_stamp)", `) AS latest`, `INNER JOIN "schema".brokers AS brokers`}},
+		{"SQLite", sqliteDialect{}, []string{"MAX(time_stamp)", `) AS latest`, "broker_stats.time_stamp\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := tt.dialect.LatestQuery(`"schema"`, "")
+			for _, s := range tt.contains {
+				if !strings.Contains(query, s) {
+					t.Errorf("LatestQuery() does not contain %q: %s", s, query)
+				}
+			}
+		})
+	}
+}
+
+func Test_placeholders(t *testing.T) {
+	tests := []struct {
+		name    string
+		dialect dialect
+		want    string
+	}{
+		{"Postgres", postgresDialect{}, "$2, $3, $4"},
+		{"SQLServer", sqlserverDialect{}, "@p2, @p3, @p4"},
+		{"Oracle", oracleDialect{}, ":2, :3, :4"},
+		{"MySQL", mysqlDialect{}, "?, ?, ?"},
+		{"SQLite", sqliteDialect{}, "?2, ?3, ?4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := placeholders(tt.dialect, 2, 3); got != tt.want {
+				t.Errorf("placeholders() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_dialect_FromTable(t *testing.T) {
+	tests := []struct {
+		name    string
+		dialect dialect
+		want    string
+	}{
+		{"Postgres", postgresDialect{}, `"schema".engine_events engine_events`},
+		{"SQLServer", sqlserverDialect{}, `"schema".engine_events AS engine_events`},
+		{"Oracle", oracleDialect{}, `"schema".engine_events engine_events`},
+		{"MySQL", mysqlDialect{}, `"schema".engine_events AS engine_events`},
+		{"SQLite", sqliteDialect{}, `"schema".engine_events AS engine_events`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.dialect.FromTable(`"schema"`, "engine_events"); got != tt.want {
+				t.Errorf("FromTable() = %q, want %q", got, tt.want)
+			}
+			want := strings.Replace(tt.want, " engine_events", " events", 1)
+			if got := tt.dialect.FromTableAs(`"schema"`, "engine_events", "events"); got != want {
+				t.Errorf("FromTableAs() = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func Test_dialect_Limit(t *testing.T) {
+	tests := []struct {
+		name    string
+		dialect dialect
+		want    string
+	}{
+		{"Postgres", postgresDialect{}, "LIMIT 10"},
+		{"SQLServer", sqlserverDialect{}, "OFFSET 0 ROWS FETCH NEXT 10 ROWS ONLY"},
+		{"Oracle", oracleDialect{}, "FETCH FIRST 10 ROWS ONLY"},
+		{"MySQL", mysqlDialect{}, "LIMIT 10"},
+		{"SQLite", sqliteDialect{}, "LIMIT 10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.dialect.Limit(10); got != tt.want {
+				t.Errorf("Limit() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
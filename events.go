@@ -0,0 +1,557 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// queryer runs named queries against the reporting database.
+type queryer interface {
+	query(name string, query string, args ...interface{}) (*queryRows, error)
+}
+
+// eventCollector counts the events in a reporting database event table.
+type eventCollector interface {
+	prometheus.Collector
+	// Read counts the events since the previous read.
+	Read(q queryer) error
+}
+
+// Paging of the event reads, so that catching up on a backlog of events (e.g. after a restart with a restored
+// watermark) does not run one unbounded query inside a scrape. The rest of a backlog is read by the next reads.
+const (
+	eventPageSize = 1000
+	eventMaxPages = 10
+)
+
+// event is an event row scanned by an eventReader.
+type event struct {
+	time  time.Time
+	key   string // Identifies the event among the events with the same timestamp
+	count func() // Counts the event
+}
+
+// eventKey returns the key of an event from its column values.
+func eventKey(values ...interface{}) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprint(v)
+	}
+	return strings.Join(parts, "\x1f")
+}
+
+// eventReader reads the rows of a reporting database event table incrementally, using the timestamp
+// of the most recent event read as a watermark. Unless the watermark is restored from the state file,
+// the first read only sets the watermark, so that events from before the exporter started are not counted.
+// The events at the watermark are read again by the next read, so that events committed late with the same
+// timestamp are not lost, and the keys of the events already counted at the watermark are kept to skip them.
+type eventReader struct {
+	name        string // Names the watermark and queries, as the same table may be read by more than one reader
+	maxQuery    string // Returns the most recent event timestamp, read from the column so that SQLite returns it as a timestamp
+	eventsQuery string // Returns a page of the events from the watermark, which is the first argument, oldest first
+	allQuery    string // Returns all of the events from the watermark, oldest first
+	watermark   time.Time
+	seen        map[string]int // The keys of the events counted at the watermark, or nil if all of them were counted
+	initialized bool
+	state       *stateFile // Only set if the watermark is persisted
+}
+
+// newEventReader returns a named eventReader for the columns of a table. If the condition is not empty,
+// only the events that match it are read. The columns and condition may refer to the table by name.
+func newEventReader(d dialect, schema string, name string, table string, columns string, condition string, state *stateFile) *eventReader {
+	query := fmt.Sprintf(`
+		SELECT %[1]s
+		FROM %[2]s
+		WHERE %[3]s.time_stamp >= %[4]s
+		%[5]s
+		ORDER BY %[3]s.time_stamp`,
+		columns, d.FromTable(schema, table), table, d.Placeholder(1), clause("AND", condition))
+	r := &eventReader{
+		name: name,
+		maxQuery: compact(fmt.Sprintf("SELECT %[2]s.time_stamp FROM %[1]s WHERE %[2]s.time_stamp = (SELECT MAX(time_stamp) FROM %[1]s)",
+			d.FromTable(schema, table), table)),
+		eventsQuery: compact(query + " " + d.Limit(eventPageSize)),
+		allQuery:    compact(query),
+		state:       state,
+	}
+	if state != nil {
+		r.watermark, r.initialized = state.Watermark(name)
+	}
+	return r
+}
+
+// Read passes the events from the watermark to the scan function, counts those not counted before, and advances
+// the watermark. The events are read a page at a time, up to a limit per read.
+func (r *eventReader) Read(q queryer, scan func(rows *sql.Rows) (event, error)) error {
+	if !r.initialized {
+		rows, err := q.query(r.name+"_watermark", r.maxQuery)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		var watermark sql.NullTime
+		if rows.Next() {
+			if err := rows.Scan(&watermark); err != nil {
+				log.WithField("error", err).Debug("Row scan failed")
+				return errors.Wrap(err, "row scan failed")
+			}
+		}
+		if err := rows.Err(); err != nil {
+			log.WithField("error", err).Debug("Row processing failed")
+			return errors.Wrap(err, "row processing failed")
+		}
+		r.watermark = watermark.Time // The zero time if there are no events yet
+		r.seen = nil
+		r.initialized = true
+		if r.state != nil {
+			r.state.SetWatermark(r.name, r.watermark)
+		}
+		log.WithField("reader", r.name).WithField("watermark", r.watermark).Debug("Event watermark initialized")
+		return nil
+	}
+
+	count := 0
+	query := r.eventsQuery
+	for page := 0; ; page++ {
+		watermark := r.watermark
+		rows, n, err := r.readPage(q, query, scan)
+		count += n
+		if err != nil {
+			return err
+		}
+		if rows < eventPageSize || query == r.allQuery {
+			break
+		}
+		if page+1 == eventMaxPages {
+			log.WithField("reader", r.name).WithField("watermark", r.watermark).Debug("Events remain, reading them on the next read")
+			break
+		}
+		// A full page of events with the same timestamp cannot be paged past, so read all of them.
+		if r.watermark.Equal(watermark) {
+			query = r.allQuery
+		}
+	}
+	if r.state != nil {
+		r.state.SetWatermark(r.name, r.watermark)
+	}
+	log.WithField("reader", r.name).WithField("events", count).WithField("watermark", r.watermark).Debug("Events read")
+	return nil
+}
+
+// readPage reads the events from the watermark with a query, counts those not counted before, and advances the
+// watermark. It returns the number of rows read and events counted.
+func (r *eventReader) readPage(q queryer, query string, scan func(rows *sql.Rows) (event, error)) (int, int, error) {
+	rows, err := q.query(r.name, query, r.watermark)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+
+	read, counted := 0, 0
+	skip := r.seen // The events at the watermark that were counted before, which are skipped once each
+	seen := map[string]int{}
+	for rows.Next() {
+		e, err := scan(rows.Rows)
+		if err != nil {
+			log.WithField("error", err).Debug("Row scan failed")
+			return read, counted, errors.Wrap(err, "row scan failed")
+		}
+		read++
+		if e.time.After(r.watermark) {
+			r.watermark = e.time
+			skip = map[string]int{}
+			seen = map[string]int{}
+		}
+		seen[e.key]++
+		r.seen = seen
+		if skip == nil {
+			continue
+		}
+		if skip[e.key] > 0 {
+			skip[e.key]--
+			continue
+		}
+		e.count()
+		counted++
+	}
+	if err := rows.Err(); err != nil {
+		log.WithField("error", err).Debug("Row processing failed")
+		return read, counted, errors.Wrap(err, "row processing failed")
+	}
+	r.seen = seen
+	return read, counted, nil
+}
+
+// engineEventLabels maps the known Engine event types to the values of the event label. Any other type is counted as
+// engineEventOther, so that the label values do not depend on the data.
+var engineEventLabels = map[string]string{
+	"LOGIN":      "login",
+	"LOGOUT":     "logout",
+	"DISCONNECT": "disconnect",
+}
+
+const engineEventOther = "other"
+
+// engineEventCollector counts the Engine login, logout and disconnect events in the reporting database.
+type engineEventCollector struct {
+	reader *eventReader
+	events *prometheus.CounterVec
+}
+
+func newEngineEventCollector(d dialect, schema string, state *stateFile) *engineEventCollector {
+	return &engineEventCollector{
+		reader: newEventReader(d, schema, "engine_events", "engine_events", fmt.Sprintf(`
+			engine_events.time_stamp,
+			(SELECT broker_name FROM %s WHERE brokers.broker_id = engine_events.broker_id),
+			engine_events.hostname,
+			engine_events.event_type`, d.FromTable(schema, "brokers")), "", state),
+		events: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "engine_events_total",
+				Help:      "Number of Engine events (login, logout, disconnect or other) since the exporter started.",
+			},
+			[]string{"broker", "engine_hostname", "event"},
+		),
+	}
+}
+
+// Read counts the Engine events since the previous read.
+func (c *engineEventCollector) Read(q queryer) error {
+	return c.reader.Read(q, func(rows *sql.Rows) (event, error) {
+		var ts time.Time
+		var broker, hostname sql.NullString
+		var eventType string
+		if err := rows.Scan(&ts, &broker, &hostname, &eventType); err != nil {
+			return event{}, err
+		}
+		name, ok := engineEventLabels[strings.ToUpper(strings.TrimSpace(eventType))]
+		if !ok {
+			name = engineEventOther
+		}
+		return event{time: ts, key: eventKey(broker.String, hostname.String, eventType), count: func() {
+			c.events.WithLabelValues(broker.String, hostname.String, name).Inc()
+		}}, nil
+	})
+}
+
+// Describe implements prometheus.Collector.
+func (c *engineEventCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.events.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *engineEventCollector) Collect(ch chan<- prometheus.Metric) {
+	c.events.Collect(ch)
+}
+
+// Service (job) and task event types.
+const (
+	eventCompleted = "COMPLETED"
+	eventFailed    = "FAILED"
+)
+
+// jobEventCollector counts the completed and failed Services in the reporting database.
+type jobEventCollector struct {
+	reader            *eventReader
+	completed, failed *prometheus.CounterVec
+}
+
+func newJobEventCollector(d dialect, schema string, state *stateFile) *jobEventCollector {
+	return &jobEventCollector{
+		reader: newEventReader(d, schema, "job_events", "job_events",
+			"job_events.time_stamp, job_events.service_type, job_events.event_type",
+			fmt.Sprintf("UPPER(job_events.event_type) IN ('%s', '%s')", eventCompleted, eventFailed),
+			state),
+		completed: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "services_completed_total",
+				Help:      "Number of Services completed.",
+			},
+			[]string{"service_type"},
+		),
+		failed: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "services_failed_total",
+				Help:      "Number of Services failed.",
+			},
+			[]string{"service_type"},
+		),
+	}
+}
+
+// Read counts the Service events since the previous read.
+func (c *jobEventCollector) Read(q queryer) error {
+	return c.reader.Read(q, func(rows *sql.Rows) (event, error) {
+		var ts time.Time
+		var serviceType sql.NullString
+		var eventType string
+		if err := rows.Scan(&ts, &serviceType, &eventType); err != nil {
+			return event{}, err
+		}
+		return event{time: ts, key: eventKey(serviceType.String, eventType), count: func() {
+			switch strings.ToUpper(strings.TrimSpace(eventType)) {
+			case eventCompleted:
+				c.completed.WithLabelValues(serviceType.String).Inc()
+			case eventFailed:
+				c.failed.WithLabelValues(serviceType.String).Inc()
+			}
+		}}, nil
+	})
+}
+
+// Describe implements prometheus.Collector.
+func (c *jobEventCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.completed.Describe(ch)
+	c.failed.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *jobEventCollector) Collect(ch chan<- prometheus.Metric) {
+	c.completed.Collect(ch)
+	c.failed.Collect(ch)
+}
+
+// taskEventCollector counts the completed tasks in the reporting database, and their durations.
+type taskEventCollector struct {
+	reader    *eventReader
+	completed *prometheus.CounterVec
+	durations *prometheus.HistogramVec
+}
+
+func newTaskEventCollector(d dialect, schema string, state *stateFile) *taskEventCollector {
+	return &taskEventCollector{
+		reader: newEventReader(d, schema, "task_events", "task_events",
+			"task_events.time_stamp, task_events.service_type, task_events.start_time",
+			fmt.Sprintf("UPPER(task_events.event_type) = '%s'", eventCompleted),
+			state),
+		completed: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "tasks_completed_total",
+				Help:      "Number of tasks completed.",
+			},
+			[]string{"service_type"},
+		),
+		durations: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Name:      "task_duration_seconds",
+				Help:      "Duration of completed tasks.",
+				Buckets:   prometheus.ExponentialBuckets(0.1, 4, 10), // 0.1 seconds to 7.3 hours
+			},
+			[]string{"service_type"},
+		),
+	}
+}
+
+// Read counts the task events since the previous read.
+func (c *taskEventCollector) Read(q queryer) error {
+	return c.reader.Read(q, func(rows *sql.Rows) (event, error) {
+		var ts time.Time
+		var serviceType sql.NullString
+		var start sql.NullTime
+		if err := rows.Scan(&ts, &serviceType, &start); err != nil {
+			return event{}, err
+		}
+		return event{time: ts, key: eventKey(serviceType.String, start.Time, start.Valid), count: func() {
+			c.completed.WithLabelValues(serviceType.String).Inc()
+			if start.Valid && !ts.Before(start.Time) {
+				c.durations.WithLabelValues(serviceType.String).Observe(ts.Sub(start.Time).Seconds())
+			}
+		}}, nil
+	})
+}
+
+// Describe implements prometheus.Collector.
+func (c *taskEventCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.completed.Describe(ch)
+	c.durations.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *taskEventCollector) Collect(ch chan<- prometheus.Metric) {
+	c.completed.Collect(ch)
+	c.durations.Collect(ch)
+}
+
+// Driver event and Service (job) submission event types.
+const (
+	eventLogin     = "LOGIN"
+	eventSubmitted = "SUBMITTED"
+)
+
+// driverLoginCollector counts the Driver logins in the reporting database, by user and Driver host.
+type driverLoginCollector struct {
+	reader    *eventReader
+	convert   func(time.Time) time.Time
+	logins    *prometheus.CounterVec
+	lastLogin *prometheus.GaugeVec
+}
+
+// newDriverLoginCollector returns a driverLoginCollector, which converts the login timestamps with a function.
+func newDriverLoginCollector(d dialect, schema string, state *stateFile, convert func(time.Time) time.Time) *driverLoginCollector {
+	return &driverLoginCollector{
+		reader: newEventReader(d, schema, "driver_events", "driver_events",
+			"driver_events.time_stamp, driver_events.username, driver_events.hostname",
+			fmt.Sprintf("UPPER(driver_events.event_type) = '%s'", eventLogin),
+			state),
+		convert: convert,
+		logins: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "driver_logins_total",
+				Help:      "Number of Driver logins.",
+			},
+			[]string{"user", "driver_hostname"},
+		),
+		lastLogin: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "driver_last_login_timestamp_seconds",
+				Help:      "Timestamp of the most recent Driver login.",
+			},
+			[]string{"user", "driver_hostname"},
+		),
+	}
+}
+
+// Read counts the Driver logins since the previous read.
+func (c *driverLoginCollector) Read(q queryer) error {
+	return c.reader.Read(q, func(rows *sql.Rows) (event, error) {
+		var ts time.Time
+		var user, hostname sql.NullString
+		if err := rows.Scan(&ts, &user, &hostname); err != nil {
+			return event{}, err
+		}
+		return event{time: ts, key: eventKey(user.String, hostname.String), count: func() {
+			c.logins.WithLabelValues(user.String, hostname.String).Inc()
+			c.lastLogin.WithLabelValues(user.String, hostname.String).Set(float64(c.convert(ts).UnixNano()) / 1e9)
+		}}, nil
+	})
+}
+
+// Describe implements prometheus.Collector.
+func (c *driverLoginCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.logins.Describe(ch)
+	c.lastLogin.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *driverLoginCollector) Collect(ch chan<- prometheus.Metric) {
+	c.logins.Collect(ch)
+	c.lastLogin.Collect(ch)
+}
+
+// jobSubmissionCollector counts the Services submitted in the reporting database.
+type jobSubmissionCollector struct {
+	reader    *eventReader
+	submitted *prometheus.CounterVec
+}
+
+func newJobSubmissionCollector(d dialect, schema string, state *stateFile) *jobSubmissionCollector {
+	return &jobSubmissionCollector{
+		reader: newEventReader(d, schema, "job_submissions", "job_events",
+			"job_events.time_stamp, job_events.service_type",
+			fmt.Sprintf("UPPER(job_events.event_type) = '%s'", eventSubmitted),
+			state),
+		submitted: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "services_submitted_total",
+				Help:      "Number of Services submitted.",
+			},
+			[]string{"service_type"},
+		),
+	}
+}
+
+// Read counts the Services submitted since the previous read.
+func (c *jobSubmissionCollector) Read(q queryer) error {
+	return c.reader.Read(q, func(rows *sql.Rows) (event, error) {
+		var ts time.Time
+		var serviceType sql.NullString
+		if err := rows.Scan(&ts, &serviceType); err != nil {
+			return event{}, err
+		}
+		return event{time: ts, key: eventKey(serviceType.String), count: func() {
+			c.submitted.WithLabelValues(serviceType.String).Inc()
+		}}, nil
+	})
+}
+
+// Describe implements prometheus.Collector.
+func (c *jobSubmissionCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.submitted.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *jobSubmissionCollector) Collect(ch chan<- prometheus.Metric) {
+	c.submitted.Collect(ch)
+}
+
+// queueWaitCollector observes the time from the submission of each Service to the start of its first task. It is
+// observed once the Service completes or fails, as only then have all of its tasks started.
+type queueWaitCollector struct {
+	reader *eventReader
+	waits  *prometheus.HistogramVec
+}
+
+func newQueueWaitCollector(d dialect, schema string, state *stateFile) *queueWaitCollector {
+	return &queueWaitCollector{
+		reader: newEventReader(d, schema, "job_queue_wait", "job_events", fmt.Sprintf(`
+			job_events.time_stamp,
+			job_events.service_type,
+			(SELECT MIN(submissions.time_stamp) FROM %s WHERE submissions.job_id = job_events.job_id AND UPPER(submissions.event_type) = '%s'),
+			(SELECT MIN(task_events.start_time) FROM %s WHERE task_events.job_id = job_events.job_id)`,
+			d.FromTableAs(schema, "job_events", "submissions"), eventSubmitted, d.FromTable(schema, "task_events")),
+			fmt.Sprintf("UPPER(job_events.event_type) IN ('%s', '%s')", eventCompleted, eventFailed),
+			state),
+		waits: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Name:      "service_queue_wait_seconds",
+				Help:      "Time from the submission of completed and failed Services to the start of their first task.",
+				Buckets:   prometheus.ExponentialBuckets(0.1, 4, 10), // 0.1 seconds to 7.3 hours
+			},
+			[]string{"service_type"},
+		),
+	}
+}
+
+// Read observes the queue wait times of the Services ended since the previous read. Services without a submission
+// event or a started task are not observed. The subquery results are scanned as nullTimestamp, as SQLite returns
+// them as text.
+func (c *queueWaitCollector) Read(q queryer) error {
+	return c.reader.Read(q, func(rows *sql.Rows) (event, error) {
+		var ts time.Time
+		var serviceType sql.NullString
+		var submitted, firstStart nullTimestamp
+		if err := rows.Scan(&ts, &serviceType, &submitted, &firstStart); err != nil {
+			return event{}, err
+		}
+		return event{time: ts, key: eventKey(serviceType.String, submitted, firstStart), count: func() {
+			if submitted.Valid && firstStart.Valid && !firstStart.Time.Before(submitted.Time) {
+				c.waits.WithLabelValues(serviceType.String).Observe(firstStart.Time.Sub(submitted.Time).Seconds())
+			}
+		}}, nil
+	})
+}
+
+// Describe implements prometheus.Collector.
+func (c *queueWaitCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.waits.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *queueWaitCollector) Collect(ch chan<- prometheus.Metric) {
+	c.waits.Collect(ch)
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestEngineEventCollector_Read(t *testing.T) {
+	start := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	batches := [][][]driver.Value{
+		{
+			{start.Add(1 * time.Second), "broker1", "engine1", "LOGIN"},
+			{start.Add(2 * time.Second), "broker1", "engine1", "LOGOUT"},
+			{start.Add(2 * time.Second), "broker1", "engine2", "LOGIN"},
+		},
+		{
+			// The events at the watermark are read again, with one committed late.
+			{start.Add(2 * time.Second), "broker1", "engine1", "LOGOUT"},
+			{start.Add(2 * time.Second), "broker1", "engine2", "LOGIN"},
+			{start.Add(2 * time.Second), "broker1", "engine3", "LOGIN"},
+			{start.Add(3 * time.Second), "broker1", "engine1", "Login "},
+			{start.Add(4 * time.Second), nil, "engine3", "DISCONNECT"},
+			{start.Add(4 * time.Second), "broker1", "engine2", "SUSPEND"},
+		},
+		{
+			{start.Add(4 * time.Second), nil, "engine3", "DISCONNECT"},
+			{start.Add(4 * time.Second), "broker1", "engine2", "SUSPEND"},
+		},
+	}
+	batch := 0
+	db, fake := newFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		if strings.Contains(query, "MAX(time_stamp)") {
+			return fakeResult{columns: []string{"max"}, rows: [][]driver.Value{{start}}}
+		}
+		rows := batches[batch]
+		batch++
+		return fakeResult{columns: []string{"time_stamp", "broker_name", "hostname", "event_type"}, rows: rows}
+	})
+	s := newTestSQLClient("postgres", "", "public", time.Second)
+	s.db = db
+	c := newEngineEventCollector(s.dialect, s.quotedSchema, nil)
+
+	for i := 0; i < 4; i++ {
+		if err := c.Read(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	queries := fake.Queries()
+	if !strings.Contains(queries[1].query, "engine_events.time_stamp >= $1") || !strings.HasSuffix(queries[1].query, "LIMIT 1000") {
+		t.Errorf("expected a paged events query from the watermark, got %q", queries[1].query)
+	}
+	wantArgs := [][]driver.Value{{}, {start}, {start.Add(2 * time.Second)}, {start.Add(4 * time.Second)}}
+	if len(queries) != len(wantArgs) {
+		t.Fatalf("expected %d queries, got %d", len(wantArgs), len(queries))
+	}
+	for i, want := range wantArgs {
+		if diff := deep.Equal(queries[i].args, want); diff != nil {
+			t.Errorf("query %d arguments: %s", i, diff)
+		}
+	}
+
+	tests := []struct {
+		labels []string
+		want   float64
+	}{
+		{[]string{"broker1", "engine1", "login"}, 2},
+		{[]string{"broker1", "engine1", "logout"}, 1},
+		{[]string{"broker1", "engine2", "login"}, 1},
+		{[]string{"broker1", "engine3", "login"}, 1},
+		{[]string{"", "engine3", "disconnect"}, 1},
+		{[]string{"broker1", "engine2", "other"}, 1},
+	}
+	for _, tt := range tests {
+		if got := readCounter(c.events.WithLabelValues(tt.labels...)); got != tt.want {
+			t.Errorf("events %v = %f, want %f", tt.labels, got, tt.want)
+		}
+	}
+	if expect, got := len(tests), testCollectorCount(c); expect != got {
+		t.Errorf("expected %d event series, got %d", expect, got)
+	}
+}
+
+func TestEventReader_ReadPages(t *testing.T) {
+	start := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	tie := start.Add(time.Hour)
+	var events []time.Time
+	for i := 1; i <= eventPageSize; i++ {
+		events = append(events, start.Add(time.Duration(i)*time.Second))
+	}
+	for i := 0; i < 1200; i++ {
+		events = append(events, tie) // More events with the same timestamp than fit in a page
+	}
+	for i := 1; i <= 300; i++ {
+		events = append(events, tie.Add(time.Duration(i)*time.Second))
+	}
+	db, fake := newFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		result := fakeResult{columns: []string{"time_stamp", "service_type"}}
+		for _, ts := range events {
+			if ts.Before(args[0].(time.Time)) {
+				continue
+			}
+			if strings.HasSuffix(query, fmt.Sprintf("LIMIT %d", eventPageSize)) && len(result.rows) == eventPageSize {
+				break
+			}
+			result.rows = append(result.rows, []driver.Value{ts, "Pricing"})
+		}
+		return result
+	})
+	s := newTestSQLClient("postgres", "", "public", time.Second)
+	s.db = db
+	state := &stateFile{watermarks: map[string]time.Time{"job_submissions": start}}
+	c := newJobSubmissionCollector(s.dialect, s.quotedSchema, state)
+	if err := c.Read(s); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second page starts at the last event of the first, the third makes no progress past the tie,
+	// so the fourth reads all of the events from the tie.
+	queries := fake.Queries()
+	wantArgs := [][]driver.Value{{start}, {start.Add(eventPageSize * time.Second)}, {tie}, {tie}}
+	if len(queries) != len(wantArgs) {
+		t.Fatalf("expected %d queries, got %d", len(wantArgs), len(queries))
+	}
+	for i, want := range wantArgs {
+		if diff := deep.Equal(queries[i].args, want); diff != nil {
+			t.Errorf("query %d arguments: %s", i, diff)
+		}
+	}
+	if strings.Contains(queries[3].query, "LIMIT") {
+		t.Errorf("expected the last query not to be paged, got %q", queries[3].query)
+	}
+	if expect, got := float64(len(events)), readCounter(c.submitted.WithLabelValues("Pricing")); expect != got {
+		t.Errorf("expected %f Services submitted, got %f", expect, got)
+	}
+
+	// Reading again counts nothing more.
+	if err := c.Read(s); err != nil {
+		t.Fatal(err)
+	}
+	if expect, got := float64(len(events)), readCounter(c.submitted.WithLabelValues("Pricing")); expect != got {
+		t.Errorf("expected %f Services submitted after reading again, got %f", expect, got)
+	}
+	if watermark, _ := state.Watermark("job_submissions"); !watermark.Equal(events[len(events)-1]) {
+		t.Errorf("expected state watermark %v, got %v", events[len(events)-1], watermark)
+	}
+}
+
+func TestEventReader_ReadError(t *testing.T) {
+	db, _ := newFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		return fakeResult{err: fmt.Errorf("table not found")}
+	})
+	s := newTestSQLClient("postgres", "", "public", time.Second)
+	s.db = db
+	c := newEngineEventCollector(s.dialect, s.quotedSchema, nil)
+	if err := c.Read(s); err == nil {
+		t.Fatalf("expected non-nil error")
+	}
+	if c.reader.initialized {
+		t.Errorf("expected watermark not to be initialized after an error")
+	}
+}
+
+// testCollectorCount returns the number of metrics delivered by a collector.
+func testCollectorCount(c prometheus.Collector) int {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+	count := 0
+	for range ch {
+		count++
+	}
+	return count
+}
+
+func TestJobEventCollector_Read(t *testing.T) {
+	start := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	db, fake := newFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		return fakeResult{columns: []string{"time_stamp", "service_type", "event_type"}, rows: [][]driver.Value{
+			{start.Add(1 * time.Second), "Pricing", "COMPLETED"},
+			{start.Add(2 * time.Second), "Pricing", "FAILED"},
+			{start.Add(3 * time.Second), "Risk", "completed"},
+			{start.Add(4 * time.Second), "Risk", "COMPLETED"},
+		}}
+	})
+	s := newTestSQLClient("postgres", "", "public", time.Second)
+	s.db = db
+
+	// The watermark is restored from the state, so the first read counts events.
+	state := &stateFile{watermarks: map[string]time.Time{"job_events": start}}
+	c := newJobEventCollector(s.dialect, s.quotedSchema, state)
+	if err := c.Read(s); err != nil {
+		t.Fatal(err)
+	}
+
+	queries := fake.Queries()
+	if len(queries) != 1 || !strings.Contains(queries[0].query, "UPPER(job_events.event_type) IN ('COMPLETED', 'FAILED')") {
+		t.Fatalf("expected a single events query, got %v", queries)
+	}
+	if diff := deep.Equal(queries[0].args, []driver.Value{start}); diff != nil {
+		t.Errorf("query arguments: %s", diff)
+	}
+	if expect, got := 1., readCounter(c.completed.WithLabelValues("Pricing")); expect != got {
+		t.Errorf("expected %f Pricing completed, got %f", expect, got)
+	}
+	if expect, got := 1., readCounter(c.failed.WithLabelValues("Pricing")); expect != got {
+		t.Errorf("expected %f Pricing failed, got %f", expect, got)
+	}
+	if expect, got := 2., readCounter(c.completed.WithLabelValues("Risk")); expect != got {
+		t.Errorf("expected %f Risk completed, got %f", expect, got)
+	}
+	if watermark, _ := state.Watermark("job_events"); !watermark.Equal(start.Add(4 * time.Second)) {
+		t.Errorf("expected state watermark to advance, got %v", watermark)
+	}
+}
+
+func TestTaskEventCollector_Read(t *testing.T) {
+	start := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	db, _ := newFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		return fakeResult{columns: []string{"time_stamp", "service_type", "start_time"}, rows: [][]driver.Value{
+			{start.Add(2 * time.Second), "Pricing", start},
+			{start.Add(3 * time.Second), "Pricing", start.Add(-time.Minute)},
+			{start.Add(4 * time.Second), "Pricing", nil},
+		}}
+	})
+	s := newTestSQLClient("postgres", "", "public", time.Second)
+	s.db = db
+	state := &stateFile{watermarks: map[string]time.Time{"task_events": start}}
+	c := newTaskEventCollector(s.dialect, s.quotedSchema, state)
+	if err := c.Read(s); err != nil {
+		t.Fatal(err)
+	}
+
+	if expect, got := 3., readCounter(c.completed.WithLabelValues("Pricing")); expect != got {
+		t.Errorf("expected %f tasks completed, got %f", expect, got)
+	}
+	pb := &dto.Metric{}
+	if err := c.durations.WithLabelValues("Pricing").(prometheus.Histogram).Write(pb); err != nil {
+		t.Fatal(err)
+	}
+	if expect, got := uint64(2), pb.GetHistogram().GetSampleCount(); expect != got {
+		t.Errorf("expected %d task durations, got %d", expect, got)
+	}
+	if expect, got := 65., pb.GetHistogram().GetSampleSum(); expect != got {
+		t.Errorf("expected %f total task duration, got %f", expect, got)
+	}
+}
+
+func TestDriverLoginCollector_Read(t *testing.T) {
+	start := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	db, fake := newFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		return fakeResult{columns: []string{"time_stamp", "username", "hostname"}, rows: [][]driver.Value{
+			{start.Add(1 * time.Second), "alice", "desk1"},
+			{start.Add(2 * time.Second), "bob", "desk2"},
+			{start.Add(3 * time.Second), "alice", "desk1"},
+			{start.Add(4 * time.Second), nil, "batch1"},
+		}}
+	})
+	s := newTestSQLClient("postgres", "", "public", time.Second)
+	s.db = db
+	s.location = time.FixedZone("", 10*60*60)
+	state := &stateFile{watermarks: map[string]time.Time{"driver_events": start}}
+	c := newDriverLoginCollector(s.dialect, s.quotedSchema, state, s.fromDatabaseTime)
+	if err := c.Read(s); err != nil {
+		t.Fatal(err)
+	}
+
+	queries := fake.Queries()
+	if len(queries) != 1 || !strings.Contains(queries[0].query, "UPPER(driver_events.event_type) = 'LOGIN'") {
+		t.Fatalf("expected a single logins query, got %v", queries)
+	}
+	tests := []struct {
+		name string
+		got  float64
+		want float64
+	}{
+		{"alice logins", readCounter(c.logins.WithLabelValues("alice", "desk1")), 2},
+		{"bob logins", readCounter(c.logins.WithLabelValues("bob", "desk2")), 1},
+		{"unknown user logins", readCounter(c.logins.WithLabelValues("", "batch1")), 1},
+		{"alice last login", readGauge(c.lastLogin.WithLabelValues("alice", "desk1")), float64(start.Add(3*time.Second - 10*time.Hour).Unix())},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %f, want %f", tt.name, tt.got, tt.want)
+		}
+	}
+	if expect, got := 6, testCollectorCount(c); expect != got {
+		t.Errorf("expected %d Driver login series, got %d", expect, got)
+	}
+}
+
+func TestJobSubmissionCollector_Read(t *testing.T) {
+	start := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	db, fake := newFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		return fakeResult{columns: []string{"time_stamp", "service_type"}, rows: [][]driver.Value{
+			{start.Add(1 * time.Second), "Pricing"},
+			{start.Add(2 * time.Second), "Pricing"},
+			{start.Add(3 * time.Second), "Risk"},
+		}}
+	})
+	s := newTestSQLClient("postgres", "", "public", time.Second)
+	s.db = db
+	// The submissions have their own watermark, separate from the Service events read from the same table.
+	state := &stateFile{watermarks: map[string]time.Time{"job_submissions": start, "job_events": start.Add(time.Hour)}}
+	c := newJobSubmissionCollector(s.dialect, s.quotedSchema, state)
+	if err := c.Read(s); err != nil {
+		t.Fatal(err)
+	}
+
+	queries := fake.Queries()
+	if len(queries) != 1 || !strings.Contains(queries[0].query, "UPPER(job_events.event_type) = 'SUBMITTED'") {
+		t.Fatalf("expected a single submissions query, got %v", queries)
+	}
+	if diff := deep.Equal(queries[0].args, []driver.Value{start}); diff != nil {
+		t.Errorf("query arguments: %s", diff)
+	}
+	if expect, got := 2., readCounter(c.submitted.WithLabelValues("Pricing")); expect != got {
+		t.Errorf("expected %f Pricing submitted, got %f", expect, got)
+	}
+	if expect, got := 1., readCounter(c.submitted.WithLabelValues("Risk")); expect != got {
+		t.Errorf("expected %f Risk submitted, got %f", expect, got)
+	}
+	if watermark, _ := state.Watermark("job_submissions"); !watermark.Equal(start.Add(3 * time.Second)) {
+		t.Errorf("expected state watermark to advance, got %v", watermark)
+	}
+}
+
+func TestQueueWaitCollector_Read(t *testing.T) {
+	start := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	db, _ := newFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		return fakeResult{columns: []string{"time_stamp", "service_type", "submitted", "first_start"}, rows: [][]driver.Value{
+			{start.Add(time.Hour), "Pricing", start, start.Add(2 * time.Second)},
+			{start.Add(time.Hour), "Pricing", start, start.Add(30 * time.Second)},
+			{start.Add(time.Hour), "Pricing", nil, start},                                // Submission purged
+			{start.Add(time.Hour), "Pricing", start, nil},                                // No task started
+			{start.Add(time.Hour), "Pricing", start, start.Add(-time.Second)},            // Started before submission
+			{start.Add(time.Hour), "Risk", "2020-06-01 12:00:00", "2020-06-01 12:01:00"}, // Returned as text by SQLite
+		}}
+	})
+	s := newTestSQLClient("postgres", "", "public", time.Second)
+	s.db = db
+	state := &stateFile{watermarks: map[string]time.Time{"job_queue_wait": start}}
+	c := newQueueWaitCollector(s.dialect, s.quotedSchema, state)
+	if err := c.Read(s); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		serviceType string
+		count       uint64
+		sum         float64
+	}{
+		{"Pricing", 2, 32},
+		{"Risk", 1, 60},
+	}
+	for _, tt := range tests {
+		pb := &dto.Metric{}
+		if err := c.waits.WithLabelValues(tt.serviceType).(prometheus.Histogram).Write(pb); err != nil {
+			t.Fatal(err)
+		}
+		if expect, got := tt.count, pb.GetHistogram().GetSampleCount(); expect != got {
+			t.Errorf("expected %d %s queue waits, got %d", expect, tt.serviceType, got)
+		}
+		if expect, got := tt.sum, pb.GetHistogram().GetSampleSum(); expect != got {
+			t.Errorf("expected %f total %s queue wait, got %f", expect, tt.serviceType, got)
+		}
+	}
+}
+
+// TestQueueWaitCollector_ReadSQLite runs the Service submission queries against a SQLite fixture file.
+func TestQueueWaitCollector_ReadSQLite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "reporting.db")
+
+	fixture, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fixture.Close()
+	statements := []string{
+		"CREATE TABLE job_events (time_stamp DATETIME, job_id INTEGER, service_type VARCHAR(255), event_type VARCHAR(32))",
+		"CREATE TABLE task_events (time_stamp DATETIME, job_id INTEGER, start_time DATETIME)",
+		"INSERT INTO job_events VALUES ('2020-06-01 09:00:00', 1, 'pricing', 'SUBMITTED')",
+		"INSERT INTO job_events VALUES ('2020-06-01 09:00:30', 2, 'pricing', 'SUBMITTED')",
+	}
+	for _, statement := range statements {
+		if _, err := fixture.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := NewSQLClient("sqlite://"+path+"?mode=ro", Credentials{}, "", time.Second, SQLOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	submissions := newJobSubmissionCollector(s.dialect, s.quotedSchema, nil)
+	waits := newQueueWaitCollector(s.dialect, s.quotedSchema, nil)
+	read := func() {
+		for _, c := range []eventCollector{submissions, waits} {
+			if err := c.Read(s); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	read() // Initializes the watermarks
+
+	statements = []string{
+		"INSERT INTO job_events VALUES ('2020-06-01 10:00:00', 3, 'pricing', 'SUBMITTED')",
+		"INSERT INTO task_events VALUES ('2020-06-01 10:00:20', 3, '2020-06-01 10:00:05')",
+		"INSERT INTO task_events VALUES ('2020-06-01 10:00:30', 3, '2020-06-01 10:00:10')",
+		"INSERT INTO job_events VALUES ('2020-06-01 10:00:40', 3, 'pricing', 'COMPLETED')",
+		"INSERT INTO task_events VALUES ('2020-06-01 10:01:00', 1, '2020-06-01 09:01:00')",
+		"INSERT INTO job_events VALUES ('2020-06-01 10:02:00', 1, 'pricing', 'FAILED')",
+	}
+	for _, statement := range statements {
+		if _, err := fixture.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read()
+
+	if expect, got := 1., readCounter(submissions.submitted.WithLabelValues("pricing")); expect != got {
+		t.Errorf("expected %f submitted, got %f", expect, got)
+	}
+	pb := &dto.Metric{}
+	if err := waits.waits.WithLabelValues("pricing").(prometheus.Histogram).Write(pb); err != nil {
+		t.Fatal(err)
+	}
+	if expect, got := uint64(2), pb.GetHistogram().GetSampleCount(); expect != got {
+		t.Errorf("expected %d queue waits, got %d", expect, got)
+	}
+	if expect, got := 65., pb.GetHistogram().GetSampleSum(); expect != got {
+		t.Errorf("expected %f total queue wait, got %f", expect, got)
+	}
+}
@@ -2,13 +2,16 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"math"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -18,25 +21,66 @@ const (
 
 // GridReport represents a snapshot of the current state of the entire grid.
 type GridReport struct {
-	BusyEngines     int
-	TotalEngines    int
-	Drivers         int
-	ServicesRunning int
+	BusyEngines     int // Not reported via SOAP while the Director is unavailable.
+	TotalEngines    int // Not reported via SOAP while the Director is unavailable.
+	Drivers         int // Not reported via SOAP while the Director is unavailable.
+	ServicesRunning int // Not reported via SOAP or REST while no Broker is reachable.
 	TasksRunning    int // Only reported via SOAP.
-	TasksPending    int
+	TasksPending    int // Not reported via SOAP or REST while no Broker is reachable.
 }
 
 // BrokerReport represents a snapshot of the current state of an individual Broker.
 type BrokerReport struct {
+	ID              string
+	URL             string
 	Hostname        string
 	Name            string
-	BusyEngines     int
-	TotalEngines    int
-	Drivers         int
-	ServicesRunning int     // Only reported via SQL.
-	TasksRunning    int     // Only reported via SOAP.
-	TasksPending    int     // Only reported via SQL.
-	UptimeMinutes   float64 // Only reported via SQL.
+	BusyEngines     int               // Not reported via SOAP while the Director is unavailable.
+	TotalEngines    int               // Not reported via SOAP while the Director is unavailable.
+	Drivers         int               // Not reported via SOAP while the Director is unavailable.
+	ServicesRunning int               // Only reported via SQL.
+	TasksRunning    int               // Only reported via SOAP.
+	TasksPending    int               // Only reported via SQL.
+	UptimeMinutes   float64           // Only reported via SQL.
+	Timestamp       time.Time         // Time of the report. Only reported via SQL.
+	Stale           bool              // The report is too old to be used. Only reported via SQL.
+	Unreachable     bool              // The per-Broker calls failed or were skipped. Only reported via SOAP or REST.
+	Aggregates      *BrokerAggregates // Only reported via SQL, if an aggregate window is set.
+}
+
+// BrokerAggregates holds aggregates of the reports of a Broker over a window, so that bursts between scrapes are not lost.
+type BrokerAggregates struct {
+	MaxBusyEngines  int
+	AvgBusyEngines  float64
+	MaxTasksPending int
+	MinTotalEngines int
+}
+
+// brokerMetricHelp is the help text of the per-Broker metrics of the reported values, by name.
+var brokerMetricHelp = map[string]string{
+	"busy_engines":       "Number of Engines busy.",
+	"total_engines":      "Number of Engines logged in.",
+	"drivers":            "Number of Drivers logged in.",
+	"services_running":   "Number of Services running.",
+	"tasks_running":      "Number of tasks running.",
+	"tasks_pending":      "Number of tasks pending (not yet assigned to Engines).",
+	"uptime_minutes":     "Time since Broker start in minutes.",
+	"busy_engines_max":   "Maximum number of Engines busy over the aggregate window.",
+	"busy_engines_avg":   "Average number of Engines busy over the aggregate window.",
+	"tasks_pending_max":  "Maximum number of tasks pending over the aggregate window.",
+	"total_engines_min":  "Minimum number of Engines logged in over the aggregate window.",
+	"start_time_seconds": "Start time of the Broker since unix epoch in seconds, derived from its uptime.",
+}
+
+// restartTolerance is how much later the start time derived from a Broker's uptime can be than the previous one
+// without counting as a restart, as the uptime is not reported at exactly the report time.
+const restartTolerance = 2 * time.Minute
+
+// brokerStart is the start time of a Broker derived from its uptime, and the uptime it was last derived from.
+type brokerStart struct {
+	start    time.Time
+	uptime   float64
+	reported time.Time
 }
 
 func newGridMetric(metricName string, docString string, constLabels prometheus.Labels) prometheus.Gauge {
@@ -50,7 +94,7 @@ func newGridMetric(metricName string, docString string, constLabels prometheus.L
 	)
 }
 
-func newBrokerMetric(metricName string, docString string, constLabels prometheus.Labels) *prometheus.GaugeVec {
+func newBrokerMetric(metricName string, docString string, constLabels prometheus.Labels, labelNames []string) *prometheus.GaugeVec {
 	return prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace:   namespace,
@@ -58,10 +102,24 @@ func newBrokerMetric(metricName string, docString string, constLabels prometheus
 			Help:        docString,
 			ConstLabels: constLabels,
 		},
-		[]string{"name", "hostname"},
+		labelNames,
 	)
 }
 
+// Options holds the settings for an Exporter and its data source.
+type Options struct {
+	Credentials  Credentials // Override any credentials in the URL
+	TLSVerify    bool
+	Schema       string
+	Timeout      time.Duration
+	DirectorOnly bool
+	SOAP         SOAPOptions
+	REST         RESTOptions
+	SQL          SQLOptions
+	Timestamps   bool // Attach the report timestamps (if any) to the per-Broker metrics
+	BrokerID     bool // Add the Broker ID to the per-Broker metric labels
+}
+
 // Exporter collects GridServer statistics from the given data source and exports them using the Prometheus metrics package.
 type Exporter struct {
 	URI                         string
@@ -71,10 +129,20 @@ type Exporter struct {
 	totalScrapes, failedScrapes prometheus.Counter
 	gridMetrics                 map[string]prometheus.Gauge
 	brokerMetrics               map[string]*prometheus.GaugeVec
+	brokerUp, brokerReportAge   *prometheus.GaugeVec // Not attached to report timestamps
+	brokerInfo                  *prometheus.GaugeVec
+	brokerRestarts              *prometheus.CounterVec
+	duplicateBrokers            prometheus.Gauge
+	brokerLabels                []string               // The label names of the per-Broker metrics
+	collectors                  []prometheus.Collector // Additional metrics reported by the data source client
+	closers                     []io.Closer            // Background work of the data source client to stop on Close
+	timestamps                  bool
+	reportTimes                 map[string]time.Time   // Report timestamps from the last scrape by Broker label values
+	brokerStarts                map[string]brokerStart // Start times derived from the uptimes by Broker label values
 }
 
 // NewExporter returns an initialized Exporter.
-func NewExporter(uri string, tlsVerify bool, schema string, timeout time.Duration, directorOnly bool) (*Exporter, error) {
+func NewExporter(uri string, opts Options) (*Exporter, error) {
 	u, err := url.Parse(uri)
 	if err != nil {
 		return nil, errors.Wrap(err, "invalid URL")
@@ -82,25 +150,64 @@ func NewExporter(uri string, tlsVerify bool, schema string, timeout time.Duratio
 
 	// Determine which client to use.
 	var fetch func() (GridReport, []BrokerReport, error)
+	var collectors []prometheus.Collector
+	var closers []io.Closer
 	switch u.Scheme {
 	case "http", "https":
-		client, err := NewSOAPClient(uri, tlsVerify, timeout, directorOnly)
+		client, err := NewSOAPClient(uri, opts.Credentials, opts.TLSVerify, opts.Timeout, opts.DirectorOnly, opts.SOAP)
 		if err != nil {
 			log.WithField("error", err).Debug("SOAP client creation failed")
 			return nil, errors.Wrap(err, "SOAP client creation failed")
 		}
 		fetch = client.Fetch()
-		u.User = url.User(u.User.Username()) // Filter password from logs
-		log.WithField("url", u.String()).WithField("tlsVerify", tlsVerify).WithField("timeout", timeout).Info("Using Web Services API")
-	case "postgres", "postgresql", "mssql", "sqlserver", "ora", "oracle":
-		client, err := NewSQLClient(uri, schema, timeout)
+		collectors = append(collectors, client)
+		closers = append(closers, client)
+		u.User = url.User(client.Username) // Filter password from logs
+		log.WithField("url", u.String()).
+			WithField("passwordFile", opts.Credentials.PasswordFile).
+			WithField("tlsVerify", opts.TLSVerify).
+			WithField("timeout", opts.Timeout).
+			WithField("retries", opts.SOAP.Retries).
+			WithField("breakerThreshold", opts.SOAP.BreakerThreshold).
+			WithField("topologyTTL", opts.SOAP.TopologyTTL).
+			WithField("proxy", redactURL(opts.SOAP.ProxyURL)).
+			WithField("headers", len(opts.SOAP.Headers)).
+			Info("Using Web Services API")
+	case "rest+http", "rest+https":
+		client, err := NewRESTClient(uri, opts.Credentials, opts.TLSVerify, opts.Timeout, opts.DirectorOnly, opts.REST)
+		if err != nil {
+			log.WithField("error", err).Debug("REST client creation failed")
+			return nil, errors.Wrap(err, "REST client creation failed")
+		}
+		fetch = client.Fetch()
+		collectors = append(collectors, client)
+		u.User = url.User(client.Username) // Filter password from logs
+		log.WithField("url", u.String()).
+			WithField("passwordFile", opts.Credentials.PasswordFile).
+			WithField("tlsVerify", opts.TLSVerify).
+			WithField("timeout", opts.Timeout).
+			WithField("retries", opts.REST.Retries).
+			WithField("breakerThreshold", opts.REST.BreakerThreshold).
+			WithField("proxy", redactURL(opts.REST.ProxyURL)).
+			WithField("headers", len(opts.REST.Headers)).
+			Info("Using REST API")
+	case "postgres", "postgresql", "mssql", "sqlserver", "ora", "oracle", "mysql", "mariadb", "sqlite":
+		client, err := NewSQLClient(uri, opts.Credentials, opts.Schema, opts.Timeout, opts.SQL)
 		if err != nil {
 			log.WithField("error", err).Debug("SQL client creation failed")
 			return nil, errors.Wrap(err, "SQL client creation failed")
 		}
+		client.Start()
 		fetch = client.Fetch()
-		u.User = url.User(u.User.Username()) // Filter password from logs
-		log.WithField("url", u.String()).WithField("driver", client.Driver).WithField("schema", client.Schema).Info("Using reporting database")
+		collectors = append(collectors, client)
+		closers = append(closers, client)
+		if u.User != nil {
+			u.User = url.User(u.User.Username()) // Filter password from logs
+		}
+		if len(opts.Credentials.Username) > 0 && u.Scheme != "sqlite" {
+			u.User = url.User(opts.Credentials.Username)
+		}
+		log.WithField("url", u.String()).WithField("passwordFile", opts.Credentials.PasswordFile).WithField("driver", client.Driver).WithField("schema", client.Schema).WithField("queryWindow", opts.SQL.QueryWindow).Info("Using reporting database")
 	case "mock":
 		client := NewMockClient()
 		fetch = client.Fetch()
@@ -109,9 +216,21 @@ func NewExporter(uri string, tlsVerify bool, schema string, timeout time.Duratio
 		return nil, fmt.Errorf("unsupported scheme: %q", u.Scheme)
 	}
 
+	labels := brokerLabelNames(opts.BrokerID)
+	brokerMetrics := map[string]*prometheus.GaugeVec{}
+	for name, help := range brokerMetricHelp {
+		brokerMetrics[name] = newBrokerMetric(name, help, nil, labels)
+	}
+
 	return &Exporter{
-		URI:   uri,
-		Fetch: fetch,
+		URI:          uri,
+		Fetch:        fetch,
+		collectors:   collectors,
+		closers:      closers,
+		timestamps:   opts.Timestamps,
+		reportTimes:  map[string]time.Time{},
+		brokerStarts: map[string]brokerStart{},
+		brokerLabels: labels,
 		up: prometheus.NewGauge(prometheus.GaugeOpts{
 			Namespace: namespace,
 			Name:      "up",
@@ -135,15 +254,20 @@ func NewExporter(uri string, tlsVerify bool, schema string, timeout time.Duratio
 			"tasks_running":    newGridMetric("tasks_running", "Number of tasks running.", nil),
 			"tasks_pending":    newGridMetric("tasks_pending", "Number of tasks pending (not yet assigned to Engines).", nil),
 		},
-		brokerMetrics: map[string]*prometheus.GaugeVec{
-			"busy_engines":     newBrokerMetric("busy_engines", "Number of Engines busy.", nil),
-			"total_engines":    newBrokerMetric("total_engines", "Number of Engines logged in.", nil),
-			"drivers":          newBrokerMetric("drivers", "Number of Drivers logged in.", nil),
-			"services_running": newBrokerMetric("services_running", "Number of Services running.", nil),
-			"tasks_running":    newBrokerMetric("tasks_running", "Number of tasks running.", nil),
-			"tasks_pending":    newBrokerMetric("tasks_pending", "Number of tasks pending (not yet assigned to Engines).", nil),
-			"uptime_minutes":   newBrokerMetric("uptime_minutes", "Time since Broker start in minutes.", nil),
-		},
+		brokerMetrics:   brokerMetrics,
+		brokerUp:        newBrokerMetric("up", "Was the last report of the Broker recent enough to be used, and the Broker reachable.", nil, labels),
+		brokerReportAge: newBrokerMetric("report_age_seconds", "Age of the last report of the Broker.", nil, labels),
+		brokerInfo:      newBrokerMetric("info", "Information about the Broker.", nil, []string{"id", "name", "hostname", "url"}),
+		brokerRestarts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "broker_restarts_total",
+			Help:      "Number of Broker restarts detected from its uptime since the exporter started.",
+		}, labels),
+		duplicateBrokers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "exporter_duplicate_brokers",
+			Help:      "Number of Brokers in the last scrape with the same labels as another Broker, which were not exported.",
+		}),
 	}, nil
 }
 
@@ -155,6 +279,14 @@ func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 	for _, m := range e.brokerMetrics {
 		m.Describe(ch)
 	}
+	e.brokerUp.Describe(ch)
+	e.brokerReportAge.Describe(ch)
+	e.brokerInfo.Describe(ch)
+	e.brokerRestarts.Describe(ch)
+	ch <- e.duplicateBrokers.Desc()
+	for _, c := range e.collectors {
+		c.Describe(ch)
+	}
 	ch <- e.up.Desc()
 	ch <- e.totalScrapes.Desc()
 	ch <- e.failedScrapes.Desc()
@@ -175,6 +307,16 @@ func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 	e.collectMetrics(ch)
 }
 
+// Close stops any background work of the data source client.
+func (e *Exporter) Close() error {
+	for _, c := range e.closers {
+		if err := c.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (e *Exporter) scrape() {
 	e.totalScrapes.Inc()
 
@@ -199,35 +341,94 @@ func (e *Exporter) scrape() {
 		WithField("tasksPending", grid.TasksPending).
 		Info("Scrape succeeded")
 
-	e.gridMetrics["busy_engines"].Set(float64(grid.BusyEngines))
-	e.gridMetrics["total_engines"].Set(float64(grid.TotalEngines))
-	e.gridMetrics["drivers"].Set(float64(grid.Drivers))
-	e.gridMetrics["services_running"].Set(float64(grid.ServicesRunning))
+	// Engine and Driver counts are not reported via SOAP while the Director is unavailable.
+	if grid.TotalEngines >= 0 {
+		e.gridMetrics["busy_engines"].Set(float64(grid.BusyEngines))
+		e.gridMetrics["total_engines"].Set(float64(grid.TotalEngines))
+		e.gridMetrics["drivers"].Set(float64(grid.Drivers))
+	}
+	// Service and task counts are not reported via SOAP while no Broker is reachable.
+	if grid.ServicesRunning >= 0 {
+		e.gridMetrics["services_running"].Set(float64(grid.ServicesRunning))
+	}
 	// TasksRunning is only reported via SOAP.
 	if grid.TasksRunning >= 0 {
 		e.gridMetrics["tasks_running"].Set(float64(grid.TasksRunning))
 	}
-	e.gridMetrics["tasks_pending"].Set(float64(grid.TasksPending))
+	if grid.TasksPending >= 0 {
+		e.gridMetrics["tasks_pending"].Set(float64(grid.TasksPending))
+	}
 
+	seen := map[string]BrokerReport{}
+	duplicates := 0
 	for _, broker := range brokers {
-		e.brokerMetrics["busy_engines"].WithLabelValues(broker.Name, broker.Hostname).Set(float64(broker.BusyEngines))
-		e.brokerMetrics["total_engines"].WithLabelValues(broker.Name, broker.Hostname).Set(float64(broker.TotalEngines))
-		e.brokerMetrics["drivers"].WithLabelValues(broker.Name, broker.Hostname).Set(float64(broker.Drivers))
+		// The info metric includes the ID, so it is exported for duplicates too.
+		e.brokerInfo.WithLabelValues(broker.ID, broker.Name, broker.Hostname, broker.URL).Set(1)
+
+		labels := brokerLabelValues(e.brokerLabels, broker)
+		key := strings.Join(labels, labelSeparator)
+		if first, ok := seen[key]; ok {
+			duplicates++
+			log.WithField("hostname", broker.Hostname).
+				WithField("name", broker.Name).
+				WithField("id", broker.ID).
+				WithField("firstID", first.ID).
+				Warn("Broker skipped, as another Broker has the same labels")
+			continue
+		}
+		seen[key] = broker
+
+		// Report timestamps are only reported via SQL.
+		if !broker.Timestamp.IsZero() {
+			e.brokerReportAge.WithLabelValues(labels...).Set(time.Since(broker.Timestamp).Seconds())
+			e.reportTimes[key] = broker.Timestamp
+		}
+		// Stale reports are only reported via SQL, and are not exported.
+		if broker.Stale {
+			e.brokerUp.WithLabelValues(labels...).Set(0)
+			log.WithField("hostname", broker.Hostname).
+				WithField("name", broker.Name).
+				WithField("timestamp", broker.Timestamp).
+				Debug("Broker metrics skipped for stale report")
+			continue
+		}
+		// Unreachable Brokers are only reported via SOAP or REST. Their Engine and Driver counts from the Director are still exported.
+		if broker.Unreachable {
+			e.brokerUp.WithLabelValues(labels...).Set(0)
+		} else {
+			e.brokerUp.WithLabelValues(labels...).Set(1)
+		}
+
+		// Engine and Driver counts are not reported via SOAP while the Director is unavailable.
+		if broker.TotalEngines >= 0 {
+			e.brokerMetrics["busy_engines"].WithLabelValues(labels...).Set(float64(broker.BusyEngines))
+			e.brokerMetrics["total_engines"].WithLabelValues(labels...).Set(float64(broker.TotalEngines))
+			e.brokerMetrics["drivers"].WithLabelValues(labels...).Set(float64(broker.Drivers))
+		}
 		// ServicesRunning is only reported via SQL.
 		if broker.ServicesRunning >= 0 {
-			e.brokerMetrics["services_running"].WithLabelValues(broker.Name, broker.Hostname).Set(float64(broker.ServicesRunning))
+			e.brokerMetrics["services_running"].WithLabelValues(labels...).Set(float64(broker.ServicesRunning))
 		}
 		// TasksRunning is only reported via SOAP.
 		if broker.TasksRunning >= 0 {
-			e.brokerMetrics["tasks_running"].WithLabelValues(broker.Name, broker.Hostname).Set(float64(broker.TasksRunning))
+			e.brokerMetrics["tasks_running"].WithLabelValues(labels...).Set(float64(broker.TasksRunning))
 		}
 		// TasksPending is only reported via SQL.
 		if broker.TasksPending >= 0 {
-			e.brokerMetrics["tasks_pending"].WithLabelValues(broker.Name, broker.Hostname).Set(float64(broker.TasksPending))
+			e.brokerMetrics["tasks_pending"].WithLabelValues(labels...).Set(float64(broker.TasksPending))
 		}
 		// Uptime is only reported via SQL.
 		if broker.UptimeMinutes >= 0 {
-			e.brokerMetrics["uptime_minutes"].WithLabelValues(broker.Name, broker.Hostname).Set(float64(broker.UptimeMinutes))
+			e.brokerMetrics["uptime_minutes"].WithLabelValues(labels...).Set(float64(broker.UptimeMinutes))
+			start := e.trackRestarts(key, labels, broker)
+			e.brokerMetrics["start_time_seconds"].WithLabelValues(labels...).Set(float64(start.UnixNano()) / 1e9)
+		}
+		// Aggregates are only reported via SQL.
+		if broker.Aggregates != nil {
+			e.brokerMetrics["busy_engines_max"].WithLabelValues(labels...).Set(float64(broker.Aggregates.MaxBusyEngines))
+			e.brokerMetrics["busy_engines_avg"].WithLabelValues(labels...).Set(broker.Aggregates.AvgBusyEngines)
+			e.brokerMetrics["tasks_pending_max"].WithLabelValues(labels...).Set(float64(broker.Aggregates.MaxTasksPending))
+			e.brokerMetrics["total_engines_min"].WithLabelValues(labels...).Set(float64(broker.Aggregates.MinTotalEngines))
 		}
 
 		log.WithField("hostname", broker.Hostname).
@@ -241,6 +442,83 @@ func (e *Exporter) scrape() {
 			WithField("uptimeMinutes", broker.UptimeMinutes).
 			Debug("Broker metrics processed")
 	}
+	e.duplicateBrokers.Set(float64(duplicates))
+
+	// Forget the start times and restart counts of the Brokers no longer reported (e.g. decommissioned or renamed).
+	for key := range e.brokerStarts {
+		if _, ok := seen[key]; !ok {
+			delete(e.brokerStarts, key)
+			e.brokerRestarts.DeleteLabelValues(strings.Split(key, labelSeparator)...)
+		}
+	}
+}
+
+// trackRestarts derives the start time of a Broker from its uptime, and counts a restart if the Broker started after
+// the previous start time. The uptime is relative to the report time, or the scrape time if the report has no time.
+// A Broker restarted since the previous report has a lower uptime, unless the reports are further apart than the
+// uptime, in which case the start time has moved later instead. Returns the start time, which is only updated on
+// a restart so that it does not jitter between reports.
+func (e *Exporter) trackRestarts(key string, labels []string, broker BrokerReport) time.Time {
+	reported := broker.Timestamp
+	if reported.IsZero() {
+		reported = time.Now()
+	}
+	current := brokerStart{
+		start:    reported.Add(-time.Duration(broker.UptimeMinutes * float64(time.Minute))),
+		uptime:   broker.UptimeMinutes,
+		reported: reported,
+	}
+	restarts := e.brokerRestarts.WithLabelValues(labels...) // Exported as 0 until the first restart
+
+	previous, ok := e.brokerStarts[key]
+	switch {
+	case !ok:
+		e.brokerStarts[key] = current
+	case !current.reported.After(previous.reported):
+		// The same report as the previous scrape.
+	case current.uptime < previous.uptime || current.start.After(previous.start.Add(restartTolerance)):
+		restarts.Inc()
+		e.brokerStarts[key] = current
+		log.WithField("hostname", broker.Hostname).
+			WithField("name", broker.Name).
+			WithField("id", broker.ID).
+			WithField("start", current.start).
+			WithField("previousStart", previous.start).
+			Info("Broker restart detected")
+	default:
+		previous.uptime = current.uptime
+		previous.reported = current.reported
+		e.brokerStarts[key] = previous
+	}
+	return e.brokerStarts[key].start
+}
+
+// labelSeparator joins label values into map keys. It cannot appear in valid UTF-8 label values.
+const labelSeparator = "\xff"
+
+// brokerLabelNames returns the names of the per-Broker metric labels. The Broker name and hostname are
+// not unique if there are multiple Brokers on a host with the same name, so the ID can be added.
+func brokerLabelNames(id bool) []string {
+	if id {
+		return []string{"id", "name", "hostname"}
+	}
+	return []string{"name", "hostname"}
+}
+
+// brokerLabelValues returns the values of the per-Broker metric labels for a Broker.
+func brokerLabelValues(labels []string, broker BrokerReport) []string {
+	values := make([]string, len(labels))
+	for i, label := range labels {
+		switch label {
+		case "id":
+			values[i] = broker.ID
+		case "name":
+			values[i] = broker.Name
+		case "hostname":
+			values[i] = broker.Hostname
+		}
+	}
+	return values
 }
 
 func (e *Exporter) resetMetrics() {
@@ -250,6 +528,10 @@ func (e *Exporter) resetMetrics() {
 	for _, m := range e.brokerMetrics {
 		m.Reset()
 	}
+	e.brokerUp.Reset()
+	e.brokerReportAge.Reset()
+	e.brokerInfo.Reset()
+	e.reportTimes = map[string]time.Time{}
 }
 
 func (e *Exporter) collectMetrics(metrics chan<- prometheus.Metric) {
@@ -257,6 +539,60 @@ func (e *Exporter) collectMetrics(metrics chan<- prometheus.Metric) {
 		m.Collect(metrics)
 	}
 	for _, m := range e.brokerMetrics {
-		m.Collect(metrics)
+		if e.timestamps {
+			e.collectWithTimestamps(m, metrics)
+		} else {
+			m.Collect(metrics)
+		}
+	}
+	e.brokerUp.Collect(metrics)
+	e.brokerReportAge.Collect(metrics)
+	e.brokerInfo.Collect(metrics)
+	e.brokerRestarts.Collect(metrics)
+	metrics <- e.duplicateBrokers
+	for _, c := range e.collectors {
+		c.Collect(metrics)
+	}
+}
+
+// collectWithTimestamps delivers the metrics of a per-Broker metric vector, with the timestamp of
+// the report that each metric came from (if known) attached.
+func (e *Exporter) collectWithTimestamps(m *prometheus.GaugeVec, metrics chan<- prometheus.Metric) {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		m.Collect(ch)
+		close(ch)
+	}()
+	for metric := range ch {
+		pb := &dto.Metric{}
+		if err := metric.Write(pb); err != nil {
+			metrics <- metric
+			continue
+		}
+		values := map[string]string{}
+		for _, label := range pb.GetLabel() {
+			values[label.GetName()] = label.GetValue()
+		}
+		labels := make([]string, len(e.brokerLabels))
+		for i, label := range e.brokerLabels {
+			labels[i] = values[label]
+		}
+		if ts, ok := e.reportTimes[strings.Join(labels, labelSeparator)]; ok {
+			metric = prometheus.NewMetricWithTimestamp(ts, metric)
+		}
+		metrics <- metric
+	}
+}
+
+// redactURL removes the password (if any) from a URL so that it can be logged.
+func redactURL(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+	if u.User == nil {
+		return uri
 	}
+	u.User = url.User(u.User.Username())
+	return u.String()
 }
@@ -51,7 +51,7 @@ func readGauge(m prometheus.Gauge) float64 {
 }
 
 func TestInvalidScheme(t *testing.T) {
-	e, err := NewExporter("gopher://gopher.quux.org", false, "", 1*time.Second, false)
+	e, err := NewExporter("gopher://gopher.quux.org", Options{Timeout: 1 * time.Second})
 	if expect, got := (*Exporter)(nil), e; expect != got {
 		t.Errorf("expected %v, got %v", expect, got)
 	}
@@ -68,7 +68,7 @@ func TestNotFound(t *testing.T) {
 	url := strings.Replace(s.URL, "http://", "http://user:pass@", 1) // Prevent SOAP client errors
 	defer s.Close()
 
-	e, err := NewExporter(url, false, "", 1*time.Second, false)
+	e, err := NewExporter(url, Options{Timeout: 1 * time.Second})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -92,3 +92,268 @@ func TestNotFound(t *testing.T) {
 		t.Errorf("expected %f failed scrapes, got %f", expect, got)
 	}
 }
+
+// gather collects the metrics from an exporter, and returns the metrics for each family by name.
+func gather(t *testing.T, e *Exporter) map[string][]*dto.Metric {
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(e)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := map[string][]*dto.Metric{}
+	for _, family := range families {
+		metrics[family.GetName()] = family.GetMetric()
+	}
+	return metrics
+}
+
+func TestExporter_StaleBrokers(t *testing.T) {
+	reportTime := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	tests := []struct {
+		name       string
+		timestamps bool
+		wantTime   int64
+	}{
+		{"NoTimestamps", false, 0},
+		{"Timestamps", true, reportTime.UnixNano() / int64(time.Millisecond)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := NewExporter("mock://", Options{Timestamps: tt.timestamps})
+			if err != nil {
+				t.Fatal(err)
+			}
+			e.Fetch = func() (GridReport, []BrokerReport, error) {
+				return GridReport{TotalEngines: 2, TasksRunning: -1},
+					[]BrokerReport{
+						{Name: "fresh", Hostname: "fresh", TotalEngines: 2, TasksRunning: -1, Timestamp: reportTime},
+						{Name: "stale", Hostname: "stale", TotalEngines: 3, TasksRunning: -1, Timestamp: reportTime, Stale: true},
+					}, nil
+			}
+
+			metrics := gather(t, e)
+			up := metrics["gridserver_broker_up"]
+			if len(up) != 2 || up[0].GetGauge().GetValue() != 1 || up[1].GetGauge().GetValue() != 0 {
+				t.Errorf("expected fresh Broker up and stale Broker down, got %v", up)
+			}
+			age := metrics["gridserver_broker_report_age_seconds"]
+			if len(age) != 2 || age[0].GetGauge().GetValue() < time.Hour.Seconds() {
+				t.Errorf("expected report ages of at least an hour, got %v", age)
+			}
+			engines := metrics["gridserver_broker_total_engines"]
+			if len(engines) != 1 || engines[0].GetGauge().GetValue() != 2 {
+				t.Fatalf("expected only fresh Broker total engines, got %v", engines)
+			}
+			if expect, got := tt.wantTime, engines[0].GetTimestampMs(); expect != got {
+				t.Errorf("expected timestamp %d, got %d", expect, got)
+			}
+		})
+	}
+}
+
+func TestExporter_UnreachableBrokers(t *testing.T) {
+	e, err := NewExporter("mock://", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Fetch = func() (GridReport, []BrokerReport, error) {
+		return GridReport{TotalEngines: 5, ServicesRunning: 1, TasksRunning: 2, TasksPending: 3},
+			[]BrokerReport{
+				{Name: "healthy", Hostname: "healthy", TotalEngines: 2, ServicesRunning: 1, TasksRunning: 2, TasksPending: 3},
+				{Name: "failed", Hostname: "failed", TotalEngines: 3, ServicesRunning: -1, TasksRunning: -1, TasksPending: -1, Unreachable: true},
+			}, nil
+	}
+
+	metrics := gather(t, e)
+	if expect, got := 1., metrics["gridserver_up"][0].GetGauge().GetValue(); expect != got {
+		t.Errorf("expected up %f, got %f", expect, got)
+	}
+	up := metrics["gridserver_broker_up"]
+	if len(up) != 2 || up[0].GetGauge().GetValue() != 0 || up[1].GetGauge().GetValue() != 1 {
+		t.Errorf("expected failed Broker down and healthy Broker up, got %v", up)
+	}
+	// The Engine counts of the failed Broker come from the Director, so they are still exported.
+	if expect, got := 2, len(metrics["gridserver_broker_total_engines"]); expect != got {
+		t.Errorf("expected %d Broker total engines, got %d", expect, got)
+	}
+	if expect, got := 1, len(metrics["gridserver_broker_tasks_running"]); expect != got {
+		t.Errorf("expected %d Broker tasks running, got %d", expect, got)
+	}
+}
+
+func TestExporter_BrokerLabels(t *testing.T) {
+	brokers := []BrokerReport{
+		{ID: "1", URL: "http://host:8000/livecluster", Name: "broker", Hostname: "host", TotalEngines: 1, TasksRunning: -1},
+		{ID: "2", URL: "http://host:8001/livecluster", Name: "broker", Hostname: "host", TotalEngines: 2, TasksRunning: -1},
+	}
+	tests := []struct {
+		name           string
+		brokerID       bool
+		wantEngines    []float64
+		wantDuplicates float64
+	}{
+		{"NameAndHostname", false, []float64{1}, 1},
+		{"BrokerID", true, []float64{1, 2}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := NewExporter("mock://", Options{BrokerID: tt.brokerID})
+			if err != nil {
+				t.Fatal(err)
+			}
+			e.Fetch = func() (GridReport, []BrokerReport, error) {
+				return GridReport{TotalEngines: 3, TasksRunning: -1}, brokers, nil
+			}
+
+			metrics := gather(t, e)
+			engines := []float64{}
+			for _, m := range metrics["gridserver_broker_total_engines"] {
+				engines = append(engines, m.GetGauge().GetValue())
+			}
+			if diff := deep.Equal(engines, tt.wantEngines); diff != nil {
+				t.Errorf("expected total engines %v, got %v", tt.wantEngines, engines)
+			}
+			if expect, got := tt.wantDuplicates, metrics["gridserver_exporter_duplicate_brokers"][0].GetGauge().GetValue(); expect != got {
+				t.Errorf("expected %f duplicate Brokers, got %f", expect, got)
+			}
+
+			info := metrics["gridserver_broker_info"]
+			if len(info) != 2 {
+				t.Fatalf("expected info for 2 Brokers, got %v", info)
+			}
+			labels := map[string]string{}
+			for _, label := range info[0].GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			want := map[string]string{"id": "1", "name": "broker", "hostname": "host", "url": "http://host:8000/livecluster"}
+			if diff := deep.Equal(labels, want); diff != nil {
+				t.Errorf("Difference: %s", diff)
+			}
+		})
+	}
+}
+
+func TestExporter_BrokerAggregates(t *testing.T) {
+	e, err := NewExporter("mock://", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Fetch = func() (GridReport, []BrokerReport, error) {
+		return GridReport{TotalEngines: 3, TasksRunning: -1},
+			[]BrokerReport{
+				{Name: "aggregated", Hostname: "host1", TotalEngines: 2, TasksRunning: -1,
+					Aggregates: &BrokerAggregates{MaxBusyEngines: 5, AvgBusyEngines: 2.5, MaxTasksPending: 7, MinTotalEngines: 1}},
+				{Name: "latest", Hostname: "host2", TotalEngines: 1, TasksRunning: -1},
+			}, nil
+	}
+
+	metrics := gather(t, e)
+	got := map[string][]float64{}
+	for _, name := range []string{"busy_engines_max", "busy_engines_avg", "tasks_pending_max", "total_engines_min"} {
+		for _, m := range metrics["gridserver_broker_"+name] {
+			got[name] = append(got[name], m.GetGauge().GetValue())
+		}
+	}
+	want := map[string][]float64{
+		"busy_engines_max":  {5},
+		"busy_engines_avg":  {2.5},
+		"tasks_pending_max": {7},
+		"total_engines_min": {1},
+	}
+	if diff := deep.Equal(got, want); diff != nil {
+		t.Errorf("expected aggregates %v, got %v", want, got)
+		t.Errorf("Difference: %s", diff)
+	}
+}
+
+func TestExporter_BrokerRestarts(t *testing.T) {
+	reportTime := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name         string
+		offset       time.Duration // Of the report time, or no report time if negative
+		uptime       float64
+		wantRestarts float64
+		wantStart    time.Time
+	}{
+		{"First", 0, 100, 0, reportTime.Add(-100 * time.Minute)},
+		{"SameReport", 0, 100, 0, reportTime.Add(-100 * time.Minute)},
+		{"Running", 30 * time.Second, 100.6, 0, reportTime.Add(-100 * time.Minute)},
+		{"Restarted", time.Minute, 0.5, 1, reportTime.Add(30 * time.Second)},
+		{"RestartedBetweenReports", 10 * time.Hour, 60, 2, reportTime.Add(9 * time.Hour)},
+		{"RunningAgain", 10*time.Hour + 30*time.Second, 60.5, 2, reportTime.Add(9 * time.Hour)},
+	}
+	e, err := NewExporter("mock://", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		e.Fetch = func() (GridReport, []BrokerReport, error) {
+			return GridReport{TasksRunning: -1},
+				[]BrokerReport{
+					{Name: "broker1", Hostname: "host1", TasksRunning: -1, UptimeMinutes: tt.uptime, Timestamp: reportTime.Add(tt.offset)},
+					{Name: "broker2", Hostname: "host2", TasksRunning: -1, UptimeMinutes: -1},
+				}, nil
+		}
+		metrics := gather(t, e)
+		restarts := metrics["gridserver_broker_restarts_total"]
+		if len(restarts) != 1 {
+			t.Fatalf("%s: expected restarts for 1 Broker, got %d", tt.name, len(restarts))
+		}
+		if got := restarts[0].GetCounter().GetValue(); got != tt.wantRestarts {
+			t.Errorf("%s: expected %f restarts, got %f", tt.name, tt.wantRestarts, got)
+		}
+		starts := metrics["gridserver_broker_start_time_seconds"]
+		if len(starts) != 1 {
+			t.Fatalf("%s: expected start time for 1 Broker, got %d", tt.name, len(starts))
+		}
+		if got, want := starts[0].GetGauge().GetValue(), float64(tt.wantStart.Unix()); got != want {
+			t.Errorf("%s: expected start time %f, got %f", tt.name, want, got)
+		}
+	}
+}
+
+func TestExporter_BrokerRestartsPruned(t *testing.T) {
+	e, err := NewExporter("mock://", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, names := range [][]string{{"broker1", "broker2"}, {"broker1"}} {
+		var brokers []BrokerReport
+		for _, name := range names {
+			brokers = append(brokers, BrokerReport{Name: name, Hostname: "host", TasksRunning: -1, UptimeMinutes: 100})
+		}
+		e.Fetch = func() (GridReport, []BrokerReport, error) {
+			return GridReport{TasksRunning: -1}, brokers, nil
+		}
+		metrics := gather(t, e)
+		if expect, got := len(names), len(e.brokerStarts); expect != got {
+			t.Errorf("%v: expected %d Broker start times, got %d", names, expect, got)
+		}
+		if expect, got := len(names), len(metrics["gridserver_broker_restarts_total"]); expect != got {
+			t.Errorf("%v: expected restarts for %d Brokers, got %d", names, expect, got)
+		}
+	}
+}
+
+func TestExporter_BrokerRestartsWithoutTimestamps(t *testing.T) {
+	e, err := NewExporter("mock://", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Sources without report times (e.g. Web Services) use the scrape time.
+	for i, uptime := range []float64{1000, 1000, 0.1, 0.2} {
+		e.Fetch = func() (GridReport, []BrokerReport, error) {
+			return GridReport{TasksRunning: -1},
+				[]BrokerReport{{Name: "broker1", Hostname: "host1", TasksRunning: -1, UptimeMinutes: uptime}}, nil
+		}
+		e.Collect(make(chan prometheus.Metric, 100))
+		want := 0.0
+		if i >= 2 {
+			want = 1
+		}
+		if got := readCounter(e.brokerRestarts.WithLabelValues("broker1", "host1")); got != want {
+			t.Errorf("scrape %d: expected %f restarts, got %f", i, want, got)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// housekeepingTables are the reporting database tables purged by the GridServer retention jobs.
+var housekeepingTables = []string{"broker_stats", "driver_events", "engine_events", "job_events", "task_events"}
+
+// housekeepingRetry is the longest time before a table that could not be read is read again.
+const housekeepingRetry = time.Minute
+
+// housekeepingCollector exports the row count and the oldest and newest timestamps of each reporting database table,
+// so that alerts can be raised if the retention jobs stop purging them. Counting the rows of a large table is slow,
+// so the tables are read in the background rather than by the scrapes, only once per interval, and the previous
+// values are exported in between.
+type housekeepingCollector struct {
+	interval time.Duration
+	queries  map[string]string // By table
+	convert  func(time.Time) time.Time
+	lastRead map[string]time.Time // The time of the last successful read, by table
+	rows     *prometheus.GaugeVec
+	oldest   *prometheus.GaugeVec
+	newest   *prometheus.GaugeVec
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// newHousekeepingCollector returns a housekeepingCollector, which converts the timestamps with a function.
+func newHousekeepingCollector(d dialect, schema string, interval time.Duration, convert func(time.Time) time.Time) *housekeepingCollector {
+	queries := map[string]string{}
+	for _, table := range housekeepingTables {
+		queries[table] = fmt.Sprintf("SELECT COUNT(*), MIN(time_stamp), MAX(time_stamp) FROM %s", d.FromTable(schema, table))
+	}
+	gauge := func(name string, help string) *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      name,
+				Help:      help,
+			},
+			[]string{"table"},
+		)
+	}
+	return &housekeepingCollector{
+		interval: interval,
+		queries:  queries,
+		convert:  convert,
+		lastRead: map[string]time.Time{},
+		stop:     make(chan struct{}),
+		rows:     gauge("reporting_table_rows", "Number of rows in the reporting database table."),
+		oldest:   gauge("reporting_table_oldest_timestamp_seconds", "Timestamp of the oldest row in the reporting database table."),
+		newest:   gauge("reporting_table_newest_timestamp_seconds", "Timestamp of the newest row in the reporting database table."),
+	}
+}
+
+// Start reads the tables in a background goroutine until Stop is called. The tables are read immediately, then
+// once per interval, and a table that could not be read is read again sooner.
+func (c *housekeepingCollector) Start(q queryer) {
+	period := c.interval
+	if period > housekeepingRetry {
+		period = housekeepingRetry
+	}
+	go func() {
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		for {
+			if err := c.Read(q); err != nil {
+				log.WithField("error", err).Warn("Table housekeeping read failed")
+			}
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop stops the background reads. It is safe to call more than once.
+func (c *housekeepingCollector) Stop() {
+	c.stopOnce.Do(func() { close(c.stop) })
+}
+
+// Read reads the tables that were not read successfully within the interval. The metrics of a table that cannot be
+// read are removed, and the other tables are still read.
+func (c *housekeepingCollector) Read(q queryer) error {
+	failed := []string{}
+	for _, table := range housekeepingTables {
+		if time.Since(c.lastRead[table]) < c.interval {
+			continue
+		}
+		if err := c.readTable(q, table); err != nil {
+			log.WithField("error", err).WithField("table", table).Debug("Table housekeeping read failed")
+			c.rows.DeleteLabelValues(table)
+			c.oldest.DeleteLabelValues(table)
+			c.newest.DeleteLabelValues(table)
+			failed = append(failed, table)
+			continue
+		}
+		c.lastRead[table] = time.Now()
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("tables not read: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// readTable reads the row count and timestamp range of a table. The timestamps are not exported for an empty table.
+func (c *housekeepingCollector) readTable(q queryer, table string) error {
+	rows, err := q.query(table+"_housekeeping", c.queries[table])
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var count int64
+	var oldest, newest nullTimestamp
+	if rows.Next() {
+		if err := rows.Scan(&count, &oldest, &newest); err != nil {
+			return errors.Wrap(err, "row scan failed")
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "row processing failed")
+	}
+
+	c.rows.WithLabelValues(table).Set(float64(count))
+	if !oldest.Valid || !newest.Valid {
+		c.oldest.DeleteLabelValues(table)
+		c.newest.DeleteLabelValues(table)
+		return nil
+	}
+	c.oldest.WithLabelValues(table).Set(float64(c.convert(oldest.Time).UnixNano()) / 1e9)
+	c.newest.WithLabelValues(table).Set(float64(c.convert(newest.Time).UnixNano()) / 1e9)
+	return nil
+}
+
+// Describe implements prometheus.Collector.
+func (c *housekeepingCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.rows.Describe(ch)
+	c.oldest.Describe(ch)
+	c.newest.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *housekeepingCollector) Collect(ch chan<- prometheus.Metric) {
+	c.rows.Collect(ch)
+	c.oldest.Collect(ch)
+	c.newest.Collect(ch)
+}
+
+// nullTimestamp is a nullable timestamp, which can also be scanned from text. SQLite returns the result of MIN or MAX
+// of a timestamp column as text, as the result has no declared type.
+type nullTimestamp struct {
+	Time  time.Time
+	Valid bool
+}
+
+// Scan implements sql.Scanner.
+func (t *nullTimestamp) Scan(value interface{}) error {
+	t.Time, t.Valid = time.Time{}, false
+	var text string
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case time.Time:
+		t.Time, t.Valid = v, true
+		return nil
+	case string:
+		text = v
+	case []byte:
+		text = string(v)
+	default:
+		return fmt.Errorf("unsupported timestamp type: %T", value)
+	}
+	text = strings.TrimSuffix(text, "Z")
+	for _, format := range sqlite3.SQLiteTimestampFormats {
+		if parsed, err := time.ParseInLocation(format, text, time.UTC); err == nil {
+			t.Time, t.Valid = parsed, true
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid timestamp: %q", text)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+func TestHousekeepingCollector_Read(t *testing.T) {
+	oldest := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	newest := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	db, fake := newFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		columns := []string{"count", "min", "max"}
+		switch {
+		case strings.Contains(query, "broker_stats"):
+			return fakeResult{columns: columns, rows: [][]driver.Value{{int64(1000), oldest, newest}}}
+		case strings.Contains(query, "driver_events"):
+			return fakeResult{columns: columns, rows: [][]driver.Value{{int64(20), oldest, newest}}}
+		case strings.Contains(query, "engine_events"):
+			return fakeResult{columns: columns, rows: [][]driver.Value{{int64(0), nil, nil}}}
+		case strings.Contains(query, "job_events"):
+			return fakeResult{columns: columns, rows: [][]driver.Value{{int64(5), "2020-05-31 00:00:00", "2020-06-01 00:00:00.5"}}}
+		}
+		return fakeResult{err: fmt.Errorf("table not found")}
+	})
+	s := newTestSQLClient("postgres", "", "public", time.Second)
+	s.db = db
+	s.location = time.FixedZone("", -10*60*60)
+	c := newHousekeepingCollector(s.dialect, s.quotedSchema, time.Hour, s.fromDatabaseTime)
+
+	err := c.Read(s)
+	if err == nil || !strings.Contains(err.Error(), "task_events") {
+		t.Errorf("Read() error = %v, want task_events not read", err)
+	}
+	// Only the table that could not be read is read again within the interval.
+	if err := c.Read(s); err == nil || err.Error() != "tables not read: task_events" {
+		t.Errorf("second Read() error = %v, want task_events not read", err)
+	}
+	if expect, got := len(housekeepingTables)+1, len(fake.Queries()); expect != got {
+		t.Errorf("expected %d queries, got %d", expect, got)
+	}
+
+	tests := []struct {
+		name string
+		got  float64
+		want float64
+	}{
+		{"broker_stats rows", readGauge(c.rows.WithLabelValues("broker_stats")), 1000},
+		{"broker_stats oldest", readGauge(c.oldest.WithLabelValues("broker_stats")), float64(oldest.Add(10 * time.Hour).Unix())},
+		{"broker_stats newest", readGauge(c.newest.WithLabelValues("broker_stats")), float64(newest.Add(10 * time.Hour).Unix())},
+		{"driver_events rows", readGauge(c.rows.WithLabelValues("driver_events")), 20},
+		{"driver_events oldest", readGauge(c.oldest.WithLabelValues("driver_events")), float64(oldest.Add(10 * time.Hour).Unix())},
+		{"engine_events rows", readGauge(c.rows.WithLabelValues("engine_events")), 0},
+		{"job_events rows", readGauge(c.rows.WithLabelValues("job_events")), 5},
+		{"job_events newest", readGauge(c.newest.WithLabelValues("job_events")), float64(time.Date(2020, 6, 1, 10, 0, 0, 0, time.UTC).Unix()) + 0.5},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %f, want %f", tt.name, tt.got, tt.want)
+		}
+	}
+	// Rows for broker_stats, driver_events, engine_events and job_events, and timestamps for broker_stats,
+	// driver_events and job_events.
+	if expect, got := 10, testCollectorCount(c); expect != got {
+		t.Errorf("expected %d housekeeping series, got %d", expect, got)
+	}
+}
+
+func TestHousekeepingCollector_ReadFailure(t *testing.T) {
+	fail := false
+	db, _ := newFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		if fail {
+			return fakeResult{err: fmt.Errorf("connection reset")}
+		}
+		ts := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+		return fakeResult{columns: []string{"count", "min", "max"}, rows: [][]driver.Value{{int64(1), ts, ts}}}
+	})
+	s := newTestSQLClient("postgres", "", "public", time.Second)
+	s.db = db
+	c := newHousekeepingCollector(s.dialect, s.quotedSchema, time.Hour, s.fromDatabaseTime)
+
+	if err := c.Read(s); err != nil {
+		t.Fatal(err)
+	}
+	if expect, got := 3*len(housekeepingTables), testCollectorCount(c); expect != got {
+		t.Errorf("expected %d housekeeping series, got %d", expect, got)
+	}
+
+	// The series are removed rather than left at their previous values.
+	fail = true
+	c.lastRead = map[string]time.Time{}
+	if err := c.Read(s); err == nil {
+		t.Error("expected an error")
+	}
+	if expect, got := 0, testCollectorCount(c); expect != got {
+		t.Errorf("expected %d housekeeping series, got %d", expect, got)
+	}
+}
+
+func TestHousekeepingCollector_Start(t *testing.T) {
+	db, fake := newFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		ts := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+		return fakeResult{columns: []string{"count", "min", "max"}, rows: [][]driver.Value{{int64(1), ts, ts}}}
+	})
+	s := newTestSQLClient("postgres", "", "public", time.Second)
+	s.db = db
+	c := newHousekeepingCollector(s.dialect, s.quotedSchema, time.Hour, s.fromDatabaseTime)
+
+	// The tables are read in the background as soon as the reads start.
+	c.Start(s)
+	defer c.Stop()
+	for deadline := time.Now().Add(time.Second); testCollectorCount(c) < 3*len(housekeepingTables); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the tables to be read")
+		}
+	}
+	c.Stop()
+	c.Stop()
+	if expect, got := len(housekeepingTables), len(fake.Queries()); expect != got {
+		t.Errorf("expected %d queries, got %d", expect, got)
+	}
+}
+
+func TestNullTimestamp_Scan(t *testing.T) {
+	ts := time.Date(2020, 6, 1, 12, 30, 15, 0, time.UTC)
+	tests := []struct {
+		value   interface{}
+		want    nullTimestamp
+		wantErr bool
+	}{
+		{nil, nullTimestamp{}, false},
+		{ts, nullTimestamp{ts, true}, false},
+		{"2020-06-01 12:30:15", nullTimestamp{ts, true}, false},
+		{"2020-06-01T12:30:15Z", nullTimestamp{ts, true}, false},
+		{[]byte("2020-06-01 12:30:15.000"), nullTimestamp{ts, true}, false},
+		{"2020-06-01 22:30:15+10:00", nullTimestamp{ts, true}, false},
+		{"yesterday", nullTimestamp{}, true},
+		{int64(1590971415), nullTimestamp{}, true},
+	}
+	for _, tt := range tests {
+		var got nullTimestamp
+		err := got.Scan(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Scan(%v) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if diff := deep.Equal(got, tt.want); diff != nil {
+			t.Errorf("Scan(%v) = %v, want %v: %s", tt.value, got, tt.want, diff)
+		}
+	}
+}
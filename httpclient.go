@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// managerURL holds the parsed URL of a GridServer Manager and the resolved credentials of the SOAP and REST clients.
+type managerURL struct {
+	Scheme       string
+	Host         string // Hostname and port, with the default port if none was supplied
+	Path         string
+	Username     string
+	Password     string
+	passwordFile *passwordFile // Only set if the password is read from a file
+}
+
+// parseManagerURL parses the URL of a GridServer Manager, which must have one of the supplied schemes.
+// The credentials override any username and password in the URL.
+func parseManagerURL(uri string, creds Credentials, schemes ...string) (*managerURL, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid URL")
+	}
+	supported := false
+	for _, scheme := range schemes {
+		if u.Scheme == scheme {
+			supported = true
+		}
+	}
+	if !supported {
+		return nil, fmt.Errorf("unsupported scheme: %q", u.Scheme)
+	}
+	username, password, passwordFile, err := creds.Resolve(u.User)
+	if err != nil {
+		return nil, err
+	}
+	if len(u.Hostname()) == 0 {
+		return nil, fmt.Errorf("hostname not set")
+	}
+	port := defaultPort
+	if len(u.Port()) > 0 {
+		intPort, err := strconv.Atoi(u.Port())
+		if err != nil || 0 > intPort || intPort > 65535 {
+			return nil, fmt.Errorf("invalid port: %q", u.Port())
+		}
+		port = strconv.Itoa(intPort)
+	}
+	return &managerURL{
+		Scheme:       u.Scheme,
+		Host:         net.JoinHostPort(u.Hostname(), port),
+		Path:         u.Path,
+		Username:     username,
+		Password:     password,
+		passwordFile: passwordFile,
+	}, nil
+}
+
+// newHTTPClient returns the HTTP client of the SOAP and REST clients, and its TLS configuration.
+func newHTTPClient(tlsVerify bool, timeout time.Duration, proxyURL string, noProxy string) (*http.Client, *tls.Config, error) {
+	proxy, err := proxyFunc(proxyURL, noProxy)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsCfg := &tls.Config{
+		InsecureSkipVerify: !tlsVerify,
+	}
+	tr := &http.Transport{
+		TLSClientConfig: tlsCfg,
+		DialContext: (&net.Dialer{
+			Timeout: timeout, // Use the user-specified timeout for the connection timeout
+		}).DialContext,
+		Proxy:                 proxy,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       30 * time.Second, // Force idle connections to time out between scrapes
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	return &http.Client{
+		Transport: tr,
+		Timeout:   timeout + 10*time.Millisecond, // Ensure connection timeout fires before request timeout
+	}, tlsCfg, nil
+}
@@ -31,6 +31,8 @@ func (m *MockClient) Fetch() func() (GridReport, []BrokerReport, error) {
 		for i := 1; i < numBrokers+1; i++ {
 			totalEngines := 10000 + r.Intn(100)
 			brokers = append(brokers, BrokerReport{
+				ID:              strconv.Itoa(i),
+				URL:             "http://broker" + strconv.Itoa(i) + ".example.com:8000/livecluster",
 				Hostname:        "broker" + strconv.Itoa(i) + ".example.com",
 				Name:            "BROKER_NAME_" + strconv.Itoa(i),
 				BusyEngines:     r.Intn(totalEngines),
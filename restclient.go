@@ -0,0 +1,339 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/version"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultRESTPath = "/livecluster/rest"
+)
+
+// RESTBroker represents a Broker in the response from the brokers resource.
+type RESTBroker struct {
+	ID              int64  `json:"id"`
+	Name            string `json:"name"`
+	BaseURL         string `json:"baseUrl"`
+	BusyEngineCount int    `json:"busyEngineCount"`
+	EngineCount     int    `json:"engineCount"`
+	DriverCount     int    `json:"driverCount"`
+}
+
+// RESTStatistics represents the response from the statistics resource of the grid or a Broker.
+type RESTStatistics struct {
+	RunningServiceCount    int `json:"runningServiceCount"`
+	RunningInvocationCount int `json:"runningInvocationCount"`
+	PendingInvocationCount int `json:"pendingInvocationCount"`
+}
+
+// RESTError represents an error response from the REST API.
+type RESTError struct {
+	Status  int    `json:"-"`
+	Message string `json:"message"`
+}
+
+func (e *RESTError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("received HTTP status %d", e.Status)
+	}
+	return fmt.Sprintf("received HTTP status %d: %s", e.Status, e.Message)
+}
+
+// RESTOptions holds the optional settings for the REST client.
+type RESTOptions struct {
+	Retries          int           // Number of times a failed request is retried
+	RetryBackoff     time.Duration // Delay before the first retry, doubled for each subsequent retry
+	BreakerThreshold int           // Number of consecutive failures before a Broker is skipped, or 0 to never skip
+	BreakerCooldown  time.Duration // Time for which a Broker is skipped
+	ProxyURL         string        // Proxy for all requests, overriding the proxy environment variables
+	NoProxy          string        // Comma-separated hosts, domains and CIDRs that bypass ProxyURL
+	Headers          http.Header   // Extra headers added to every request
+}
+
+// RESTClient is a client for the GridServer REST administration API.
+type RESTClient struct {
+	URL          string
+	Username     string
+	Password     string
+	TLSConfig    *tls.Config
+	Timeout      time.Duration
+	DirectorOnly bool
+	RESTOptions
+	passwordFile *passwordFile // Only set if the password is read from a file
+	client       *http.Client
+	breakers     *brokerBreakers
+}
+
+// NewRESTClient returns a new RESTClient configured for accessing a GridServer Manager.
+// The URL scheme must be "rest+http" or "rest+https". The credentials override any username and password in the URL.
+func NewRESTClient(uri string, creds Credentials, tlsVerify bool, timeout time.Duration, directorOnly bool, opts RESTOptions) (*RESTClient, error) {
+	m, err := parseManagerURL(uri, creds, "rest+http", "rest+https")
+	if err != nil {
+		return nil, err
+	}
+	httpClient, tlsCfg, err := newHTTPClient(tlsVerify, timeout, opts.ProxyURL, opts.NoProxy)
+	if err != nil {
+		return nil, err
+	}
+
+	base := &url.URL{
+		Scheme: strings.TrimPrefix(m.Scheme, "rest+"),
+		Host:   m.Host,
+		Path:   cleanRESTPath(m.Path),
+	}
+	return &RESTClient{
+		URL:          base.String(),
+		Username:     m.Username,
+		Password:     m.Password,
+		TLSConfig:    tlsCfg,
+		Timeout:      timeout,
+		DirectorOnly: directorOnly,
+		RESTOptions:  opts,
+		passwordFile: m.passwordFile,
+		client:       httpClient,
+		breakers:     newBrokerBreakers(opts.BreakerThreshold, opts.BreakerCooldown),
+	}, nil
+}
+
+// Describe describes the metrics reported by the REST client itself. It implements prometheus.Collector.
+func (r *RESTClient) Describe(ch chan<- *prometheus.Desc) {
+	r.breakers.states.Describe(ch)
+}
+
+// Collect delivers the metrics reported by the REST client itself. It implements prometheus.Collector.
+func (r *RESTClient) Collect(ch chan<- prometheus.Metric) {
+	r.breakers.states.Collect(ch)
+}
+
+// cleanRESTPath attempts to clean up the supplied path.
+func cleanRESTPath(path string) string {
+	trimmed := strings.Trim(path, "/")
+	if trimmed == "" || trimmed == "livecluster" {
+		return defaultRESTPath
+	}
+	return strings.TrimRight(path, "/")
+}
+
+// Get retrieves the requested resource and decodes the JSON response. Failures due to network errors
+// or gateway errors are retried with jittered exponential backoff, within the timeout.
+func (r *RESTClient) Get(resource string, response interface{}) error {
+	return callWithRetries(r.Retries, r.RetryBackoff, r.Timeout, log.WithField("resource", resource), func() error {
+		return r.get(resource, response)
+	})
+}
+
+// get makes a single attempt at retrieving the requested resource.
+func (r *RESTClient) get(resource string, response interface{}) error {
+	endpoint := r.URL + "/" + resource
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		log.WithField("error", err).WithField("url", endpoint).Debug("HTTP request creation failed")
+		return errors.Wrap(err, "HTTP request creation failed")
+	}
+	password := r.Password
+	if r.passwordFile != nil {
+		password, _, err = r.passwordFile.Read()
+		if err != nil {
+			log.WithField("error", err).WithField("path", r.passwordFile.path).Debug("Password file read failed")
+			return err
+		}
+	}
+	// The extra headers are added first, so that they cannot override the headers of the request.
+	for name, values := range r.Headers {
+		req.Header[name] = values
+	}
+	req.SetBasicAuth(r.Username, password)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "gridserver-exporter/"+version.Version)
+
+	client := r.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		log.WithField("url", endpoint).WithField("error", err).Debug("HTTP request failed")
+		return &retryableError{errors.Wrap(err, "HTTP request failed")}
+	}
+	defer res.Body.Close()
+
+	rawbody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		log.WithField("error", err).WithField("response", string(rawbody)).WithField("url", endpoint).Debug("HTTP response body read failed")
+		return &retryableError{errors.Wrap(err, "HTTP response body read failed")}
+	}
+	log.WithField("response", string(rawbody)).WithField("status", res.Status).WithField("url", endpoint).Trace("REST response received")
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		restErr := &RESTError{}
+		json.Unmarshal(rawbody, restErr) // The message is optional, and may be absent from e.g. proxy error pages
+		restErr.Status = res.StatusCode
+		log.WithField("error", restErr).WithField("response", string(rawbody)).WithField("url", endpoint).Debug("Received REST error")
+		switch res.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return &retryableError{errors.Wrap(restErr, "received REST error")}
+		}
+		return errors.Wrap(restErr, "received REST error")
+	}
+	if len(rawbody) == 0 {
+		return fmt.Errorf("received empty response from server")
+	}
+
+	err = json.Unmarshal(rawbody, response)
+	if err != nil {
+		log.WithField("error", err).WithField("response", string(rawbody)).WithField("url", endpoint).Debug("Received invalid REST response")
+		return errors.Wrap(err, "received invalid REST response")
+	}
+	return nil
+}
+
+// TimedGet wraps the Get function to measure its duration.
+func (r *RESTClient) TimedGet(resource string, response interface{}) (elapsed time.Duration, err error) {
+	start := time.Now()
+	err = r.Get(resource, response)
+	elapsed = time.Since(start).Round(time.Millisecond)
+	return
+}
+
+// GetBrokers returns the current snapshot of Broker information from the brokers resource.
+func (r *RESTClient) GetBrokers() ([]RESTBroker, time.Duration, error) {
+	var response []RESTBroker
+	elapsed, err := r.TimedGet("brokers", &response)
+	if err != nil {
+		return nil, elapsed, errors.Wrap(err, "REST call failed")
+	}
+	return response, elapsed, nil
+}
+
+// GetStatistics returns the current service and task counts from the statistics resource of the grid,
+// or of a single Broker if a Broker ID is supplied.
+func (r *RESTClient) GetStatistics(brokerID *int64) (*RESTStatistics, time.Duration, error) {
+	resource := "statistics"
+	if brokerID != nil {
+		resource = "brokers/" + strconv.FormatInt(*brokerID, 10) + "/statistics"
+	}
+	response := new(RESTStatistics)
+	elapsed, err := r.TimedGet(resource, response)
+	if err != nil {
+		return nil, elapsed, errors.Wrap(err, "REST call failed")
+	}
+	return response, elapsed, nil
+}
+
+// Fetch retrieves the most recent Broker and grid reports from the REST API.
+func (r *RESTClient) Fetch() func() (GridReport, []BrokerReport, error) {
+	return func() (GridReport, []BrokerReport, error) {
+		grid := GridReport{}
+		brokers := []BrokerReport{}
+		director, _ := url.Parse(r.URL)
+		hostname := director.Hostname()
+
+		// Get the Brokers and their basic metrics.
+		restBrokers, elapsed, err := r.GetBrokers()
+		if err != nil {
+			log.WithField("elapsed", elapsed).WithField("hostname", hostname).WithField("error", err).Debug("REST brokers request failed")
+			return grid, nil, errors.Wrap(err, "REST brokers request failed")
+		}
+		log.WithField("elapsed", elapsed).WithField("hostname", hostname).WithField("brokers", len(restBrokers)).Debug("REST brokers request succeeded")
+
+		r.breakers.Begin()
+		for _, restBroker := range restBrokers {
+			baseURL, _ := url.Parse(restBroker.BaseURL)
+			broker := BrokerReport{
+				ID:              strconv.FormatInt(restBroker.ID, 10),
+				URL:             restBroker.BaseURL,
+				Name:            restBroker.Name,
+				Hostname:        baseURL.Hostname(),
+				BusyEngines:     restBroker.BusyEngineCount,
+				TotalEngines:    restBroker.EngineCount,
+				Drivers:         restBroker.DriverCount,
+				ServicesRunning: -1,
+				TasksRunning:    -1,
+				TasksPending:    -1,
+				UptimeMinutes:   -1,
+			}
+
+			// If not operating in Director only mode, collect the per-Broker metrics unless the Broker is being skipped.
+			if !r.DirectorOnly {
+				id := restBroker.ID
+				r.breakers.Call(&broker, func() error {
+					stats, elapsed, err := r.GetStatistics(&id)
+					if err != nil {
+						log.WithField("elapsed", elapsed).WithField("hostname", broker.Hostname).WithField("name", broker.Name).WithField("error", err).Debug("REST Broker statistics request failed")
+						return errors.Wrap(err, "REST Broker statistics request failed")
+					}
+					broker.ServicesRunning = stats.RunningServiceCount
+					broker.TasksRunning = stats.RunningInvocationCount
+					broker.TasksPending = stats.PendingInvocationCount
+					log.WithField("elapsed", elapsed).
+						WithField("hostname", broker.Hostname).
+						WithField("name", broker.Name).
+						WithField("servicesRunning", broker.ServicesRunning).
+						WithField("tasksRunning", broker.TasksRunning).
+						WithField("tasksPending", broker.TasksPending).
+						Debug("REST Broker statistics request succeeded")
+					return nil
+				})
+			}
+
+			brokers = append(brokers, broker)
+		}
+		r.breakers.End()
+
+		// Sum the individual broker reports to calculate a whole grid report.
+		// Brokers that failed or were skipped by their circuit breakers do not contribute per-Broker metrics.
+		reported := false
+		for _, broker := range brokers {
+			grid.BusyEngines += broker.BusyEngines
+			grid.TotalEngines += broker.TotalEngines
+			grid.Drivers += broker.Drivers
+
+			// If not operating in Director only mode, use the per-Broker metrics.
+			if !r.DirectorOnly && broker.ServicesRunning >= 0 {
+				grid.ServicesRunning += broker.ServicesRunning
+				grid.TasksRunning += broker.TasksRunning
+				grid.TasksPending += broker.TasksPending
+				reported = true
+			}
+		}
+		// If no Broker reported, the per-Broker totals are unknown rather than 0.
+		if !r.DirectorOnly && !reported && len(brokers) > 0 {
+			grid.ServicesRunning = -1
+			grid.TasksRunning = -1
+			grid.TasksPending = -1
+		}
+
+		// If operating in Director only mode, the following metrics will not have been obtained from the Brokers,
+		// but they can be obtained at the grid level.
+		if r.DirectorOnly {
+			stats, elapsed, err := r.GetStatistics(nil)
+			if err != nil {
+				log.WithField("elapsed", elapsed).WithField("hostname", hostname).WithField("error", err).Debug("REST statistics request failed")
+				return grid, nil, errors.Wrap(err, "REST statistics request failed")
+			}
+			grid.ServicesRunning = stats.RunningServiceCount
+			grid.TasksRunning = stats.RunningInvocationCount
+			grid.TasksPending = stats.PendingInvocationCount
+			log.WithField("elapsed", elapsed).
+				WithField("hostname", hostname).
+				WithField("servicesRunning", grid.ServicesRunning).
+				WithField("tasksRunning", grid.TasksRunning).
+				WithField("tasksPending", grid.TasksPending).
+				Debug("REST statistics request succeeded")
+		}
+
+		return grid, brokers, nil
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// requiredTable is a reporting database table, and the columns of it read by the exporter.
+type requiredTable struct {
+	name    string
+	columns []string
+}
+
+// requiredTables returns the tables read by the exporter with its current options.
+func (s *SQLClient) requiredTables() []requiredTable {
+	tables := []requiredTable{
+		{"brokers", []string{"broker_id", "broker_url", "broker_name"}},
+		{"broker_stats", []string{"broker_id", "time_stamp", "num_busy_engines", "num_total_engines", "num_drivers", "uptime_minutes", "num_jobs_running", "num_tasks_pending"}},
+	}
+	if s.EngineEvents {
+		tables = append(tables, requiredTable{"engine_events", []string{"time_stamp", "broker_id", "hostname", "event_type"}})
+	}
+	if s.ServiceEvents {
+		tables = append(tables,
+			requiredTable{"job_events", []string{"time_stamp", "service_type", "event_type"}},
+			requiredTable{"task_events", []string{"time_stamp", "service_type", "event_type", "start_time"}},
+		)
+	}
+	if s.EngineSeconds {
+		tables = requireColumns(tables, "task_events", "time_stamp", "job_id", "service_type", "event_type", "start_time")
+		tables = requireColumns(tables, "job_events", "job_id", "username")
+	}
+	if s.DriverEvents {
+		tables = append(tables, requiredTable{"driver_events", []string{"time_stamp", "username", "hostname", "event_type"}})
+	}
+	if s.ServiceSubmissions {
+		tables = requireColumns(tables, "job_events", "time_stamp", "job_id", "service_type", "event_type")
+		tables = requireColumns(tables, "task_events", "job_id", "start_time")
+	}
+	return tables
+}
+
+// requireColumns adds the columns of a table to the required tables, unless they are already required.
+func requireColumns(tables []requiredTable, name string, columns ...string) []requiredTable {
+	for i := range tables {
+		if tables[i].name == name {
+			for _, column := range columns {
+				if !containsFold(tables[i].columns, column) {
+					tables[i].columns = append(tables[i].columns, column)
+				}
+			}
+			return tables
+		}
+	}
+	return append(tables, requiredTable{name, columns})
+}
+
+// Check verifies that the tables and columns read by the exporter exist in the schema and are readable.
+// It returns a description of each table or column that is missing or unreadable, or an error if the
+// database cannot be reached. No rows are read, so the check is cheap even on large tables.
+func (s *SQLClient) Check() ([]string, error) {
+	ctx := context.Background()
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+	if err := s.database().PingContext(ctx); err != nil {
+		log.WithField("error", err).Debug("Database connection failed")
+		return nil, errors.Wrap(err, "database connection failed")
+	}
+
+	problems := []string{}
+	for _, table := range s.requiredTables() {
+		columns, err := s.tableColumns(ctx, table.name)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("table %s.%s is missing or not readable: %v", s.quotedSchema, table.name, err))
+			continue
+		}
+		for _, column := range table.columns {
+			if !containsFold(columns, column) {
+				problems = append(problems, fmt.Sprintf("column %s.%s.%s is missing", s.quotedSchema, table.name, column))
+			}
+		}
+	}
+	return problems, nil
+}
+
+// tableColumns returns the names of the columns of a table, by selecting from it without reading any rows.
+func (s *SQLClient) tableColumns(ctx context.Context, table string) ([]string, error) {
+	rows, err := s.queryContext(ctx, "check_"+table, fmt.Sprintf("SELECT * FROM %s WHERE 1 = 0", s.dialect.FromTable(s.quotedSchema, table)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, errors.Wrap(err, "column names read failed")
+	}
+	return columns, nil
+}
+
+// containsFold reports whether a list contains a string, ignoring case, as the databases fold column names differently.
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+func TestSQLClient_Check(t *testing.T) {
+	allColumns := map[string][]string{
+		"brokers":       {"broker_id", "broker_url", "broker_name", "broker_type"},
+		"broker_stats":  {"broker_id", "time_stamp", "num_busy_engines", "num_total_engines", "num_drivers", "uptime_minutes", "num_jobs_running", "num_tasks_pending"},
+		"engine_events": {"time_stamp", "broker_id", "hostname", "event_type"},
+	}
+	tests := []struct {
+		name   string
+		driver string
+		opts   SQLOptions
+		tables map[string][]string
+		want   []string
+	}{
+		{"AllPresent", "postgres", SQLOptions{}, allColumns, []string{}},
+		{"UpperCaseColumns", "godror", SQLOptions{},
+			map[string][]string{
+				"brokers":      {"BROKER_ID", "BROKER_URL", "BROKER_NAME"},
+				"broker_stats": {"BROKER_ID", "TIME_STAMP", "NUM_BUSY_ENGINES", "NUM_TOTAL_ENGINES", "NUM_DRIVERS", "UPTIME_MINUTES", "NUM_JOBS_RUNNING", "NUM_TASKS_PENDING"},
+			},
+			[]string{},
+		},
+		{"MissingColumns", "sqlserver", SQLOptions{},
+			map[string][]string{
+				"brokers":      {"broker_id", "broker_name"},
+				"broker_stats": {"broker_id", "time_stamp", "num_busy_engines", "num_total_engines", "num_drivers", "uptime_minutes", "num_jobs_running"},
+			},
+			[]string{
+				"column [public].brokers.broker_url is missing",
+				"column [public].broker_stats.num_tasks_pending is missing",
+			},
+		},
+		{"MissingTable", "postgres", SQLOptions{},
+			map[string][]string{"brokers": allColumns["brokers"]},
+			[]string{`table "public".broker_stats is missing or not readable: SQL query failed: relation does not exist`},
+		},
+		{"EventTables", "postgres", SQLOptions{EngineEvents: true, ServiceEvents: true}, allColumns,
+			[]string{
+				`table "public".job_events is missing or not readable: SQL query failed: relation does not exist`,
+				`table "public".task_events is missing or not readable: SQL query failed: relation does not exist`,
+			},
+		},
+		{"EngineSecondsColumns", "postgres", SQLOptions{ServiceEvents: true, EngineSeconds: true},
+			map[string][]string{
+				"brokers":      allColumns["brokers"],
+				"broker_stats": allColumns["broker_stats"],
+				"job_events":   {"time_stamp", "service_type", "event_type"},
+				"task_events":  {"time_stamp", "service_type", "event_type", "start_time"},
+			},
+			[]string{
+				`column "public".job_events.job_id is missing`,
+				`column "public".job_events.username is missing`,
+				`column "public".task_events.job_id is missing`,
+			},
+		},
+		{"DriverEventsTable", "postgres", SQLOptions{DriverEvents: true}, allColumns,
+			[]string{`table "public".driver_events is missing or not readable: SQL query failed: relation does not exist`},
+		},
+		{"ServiceSubmissionsColumns", "postgres", SQLOptions{ServiceEvents: true, ServiceSubmissions: true},
+			map[string][]string{
+				"brokers":      allColumns["brokers"],
+				"broker_stats": allColumns["broker_stats"],
+				"job_events":   {"time_stamp", "service_type", "event_type"},
+				"task_events":  {"time_stamp", "service_type", "event_type", "start_time"},
+			},
+			[]string{
+				`column "public".job_events.job_id is missing`,
+				`column "public".task_events.job_id is missing`,
+			},
+		},
+		{"EngineSecondsTables", "postgres", SQLOptions{EngineSeconds: true}, allColumns,
+			[]string{
+				`table "public".task_events is missing or not readable: SQL query failed: relation does not exist`,
+				`table "public".job_events is missing or not readable: SQL query failed: relation does not exist`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, _ := newFakeDB(t, func(query string, args []driver.Value) fakeResult {
+				for table, columns := range tt.tables {
+					if strings.Contains(query, "."+table+" ") {
+						return fakeResult{columns: columns}
+					}
+				}
+				return fakeResult{err: fmt.Errorf("relation does not exist")}
+			})
+			s := newTestSQLClient(tt.driver, "", "public", time.Second)
+			s.db = db
+			s.SQLOptions = tt.opts
+			got, err := s.Check()
+			if err != nil {
+				t.Fatalf("Check() error = %v", err)
+			}
+			if diff := deep.Equal(got, tt.want); diff != nil {
+				t.Errorf("Check() = %v, want %v", got, tt.want)
+				t.Errorf("Difference: %s", diff)
+			}
+		})
+	}
+}
+
+func TestSQLClient_CheckConnectionFailed(t *testing.T) {
+	db, err := sql.Open("fake", "unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestSQLClient("postgres", "", "public", time.Second)
+	s.db = db
+	if _, err := s.Check(); err == nil {
+		t.Errorf("expected non-nil error")
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Placeholders in the session statements, replaced by the statement timeout.
+const (
+	timeoutMillisPlaceholder  = "{{timeout_ms}}"
+	timeoutSecondsPlaceholder = "{{timeout_seconds}}"
+)
+
+// isolationLevels are the isolation levels that can be set in the configuration file, by name.
+var isolationLevels = map[string]sql.IsolationLevel{
+	"default":          sql.LevelDefault,
+	"read_uncommitted": sql.LevelReadUncommitted,
+	"read_committed":   sql.LevelReadCommitted,
+	"repeatable_read":  sql.LevelRepeatableRead,
+	"snapshot":         sql.LevelSnapshot,
+	"serializable":     sql.LevelSerializable,
+}
+
+// sessionDrivers are the database drivers whose session settings can be set in the configuration file.
+var sessionDrivers = []string{"godror", "mysql", "postgres", "sqlite3", "sqlserver"}
+
+// SessionConfig overrides the settings of the read-only transactions for a database driver. Unset fields keep
+// the defaults of the driver's dialect.
+type SessionConfig struct {
+	Isolation  string   `yaml:"isolation"`  // Isolation level, e.g. "read_committed"
+	ReadOnly   *bool    `yaml:"read_only"`  // Whether the transactions are started as read-only
+	Statements []string `yaml:"statements"` // Run at the start of each transaction, replacing the default statements
+	// Run at the end of each transaction, replacing the default reset statements
+	ResetStatements []string `yaml:"reset_statements"`
+}
+
+// Validate checks the session settings of a driver.
+func (c SessionConfig) Validate(driver string) error {
+	if i := sort.SearchStrings(sessionDrivers, driver); i == len(sessionDrivers) || sessionDrivers[i] != driver {
+		return fmt.Errorf("unknown session driver: %q (valid drivers: %s)", driver, strings.Join(sessionDrivers, ", "))
+	}
+	if _, ok := isolationLevels[c.Isolation]; len(c.Isolation) > 0 && !ok {
+		return fmt.Errorf("invalid %s session isolation level: %q", driver, c.Isolation)
+	}
+	return nil
+}
+
+// session holds the settings of the read-only transactions that the queries run in.
+type session struct {
+	options         *sql.TxOptions
+	statements      []string // With the placeholders replaced
+	resetStatements []string
+	timeout         time.Duration
+}
+
+// newSession returns the session settings for a dialect, overridden by the configuration for the driver (if any).
+// Statements with a timeout placeholder are left out if the timeout is not greater than 0, as 0 means no wait
+// rather than no limit for some databases (e.g. SQL Server LOCK_TIMEOUT).
+func newSession(d dialect, timeout time.Duration, config *SessionConfig) *session {
+	options := d.TxOptions()
+	statements := d.SessionStatements()
+	resetStatements := d.SessionResetStatements()
+	if config != nil {
+		if len(config.Isolation) > 0 {
+			options.Isolation = isolationLevels[config.Isolation]
+		}
+		if config.ReadOnly != nil {
+			options.ReadOnly = *config.ReadOnly
+		}
+		if config.Statements != nil {
+			statements = config.Statements
+		}
+		if config.ResetStatements != nil {
+			resetStatements = config.ResetStatements
+		}
+	}
+
+	replacer := strings.NewReplacer(
+		timeoutMillisPlaceholder, strconv.FormatInt(int64(timeout/time.Millisecond), 10),
+		timeoutSecondsPlaceholder, strconv.FormatFloat(timeout.Seconds(), 'f', -1, 64),
+	)
+	s := &session{options: &options, resetStatements: resetStatements, timeout: timeout}
+	for _, statement := range statements {
+		if timeout <= 0 && (strings.Contains(statement, timeoutMillisPlaceholder) || strings.Contains(statement, timeoutSecondsPlaceholder)) {
+			continue
+		}
+		s.statements = append(s.statements, replacer.Replace(statement))
+	}
+	return s
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+func Test_newSession(t *testing.T) {
+	readWrite := false
+	tests := []struct {
+		name    string
+		dialect dialect
+		timeout time.Duration
+		config  *SessionConfig
+		want    *session
+	}{
+		{
+			"Postgres",
+			postgresDialect{},
+			1500 * time.Millisecond,
+			nil,
+			&session{
+				options:    &sql.TxOptions{Isolation: sql.LevelReadCommitted, ReadOnly: true},
+				statements: []string{"SET LOCAL statement_timeout = 1500", "SET LOCAL lock_timeout = 1500"},
+				timeout:    1500 * time.Millisecond,
+			},
+		},
+		{
+			"SQLServer",
+			sqlserverDialect{},
+			10 * time.Second,
+			nil,
+			&session{
+				options:    &sql.TxOptions{Isolation: sql.LevelReadCommitted},
+				statements: []string{"SET LOCK_TIMEOUT 10000"},
+				timeout:    10 * time.Second,
+			},
+		},
+		{
+			"MySQL",
+			mysqlDialect{},
+			2500 * time.Millisecond,
+			nil,
+			&session{
+				options:         &sql.TxOptions{Isolation: sql.LevelReadCommitted, ReadOnly: true},
+				statements:      []string{"SET SESSION max_execution_time = 2500"},
+				resetStatements: []string{"SET SESSION max_execution_time = DEFAULT"},
+				timeout:         2500 * time.Millisecond,
+			},
+		},
+		{
+			"MariaDB",
+			mariadbDialect{},
+			2500 * time.Millisecond,
+			nil,
+			&session{
+				options:         &sql.TxOptions{Isolation: sql.LevelReadCommitted, ReadOnly: true},
+				statements:      []string{"SET SESSION max_statement_time = 2.5"},
+				resetStatements: []string{"SET SESSION max_statement_time = DEFAULT"},
+				timeout:         2500 * time.Millisecond,
+			},
+		},
+		{
+			"Oracle",
+			oracleDialect{},
+			10 * time.Second,
+			nil,
+			&session{options: &sql.TxOptions{ReadOnly: true}, timeout: 10 * time.Second},
+		},
+		{
+			"NoTimeout",
+			postgresDialect{},
+			0,
+			nil,
+			&session{options: &sql.TxOptions{Isolation: sql.LevelReadCommitted, ReadOnly: true}},
+		},
+		{
+			"Statements",
+			mysqlDialect{},
+			2500 * time.Millisecond,
+			&SessionConfig{
+				Statements:      []string{"SET SESSION max_statement_time = {{timeout_seconds}}", "SET SESSION sql_mode = 'ANSI'"},
+				ResetStatements: []string{"SET SESSION sql_mode = DEFAULT"},
+			},
+			&session{
+				options:         &sql.TxOptions{Isolation: sql.LevelReadCommitted, ReadOnly: true},
+				statements:      []string{"SET SESSION max_statement_time = 2.5", "SET SESSION sql_mode = 'ANSI'"},
+				resetStatements: []string{"SET SESSION sql_mode = DEFAULT"},
+				timeout:         2500 * time.Millisecond,
+			},
+		},
+		{
+			"StatementsWithoutResets",
+			mysqlDialect{},
+			2500 * time.Millisecond,
+			&SessionConfig{Statements: []string{"SET SESSION max_execution_time = {{timeout_ms}}", "SET SESSION sql_mode = 'ANSI'"}},
+			&session{
+				options:         &sql.TxOptions{Isolation: sql.LevelReadCommitted, ReadOnly: true},
+				statements:      []string{"SET SESSION max_execution_time = 2500", "SET SESSION sql_mode = 'ANSI'"},
+				resetStatements: []string{"SET SESSION max_execution_time = DEFAULT"},
+				timeout:         2500 * time.Millisecond,
+			},
+		},
+		{
+			"Overrides",
+			postgresDialect{},
+			time.Second,
+			&SessionConfig{Isolation: "repeatable_read", ReadOnly: &readWrite, Statements: []string{}},
+			&session{options: &sql.TxOptions{Isolation: sql.LevelRepeatableRead}, timeout: time.Second},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := newSession(tt.dialect, tt.timeout, tt.config)
+			if diff := deep.Equal(got, tt.want); diff != nil {
+				t.Errorf("newSession() = %+v, want %+v: %s", got, tt.want, diff)
+			}
+		})
+	}
+}
+
+func TestSessionConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		driver  string
+		config  SessionConfig
+		wantErr bool
+	}{
+		{"Empty", "postgres", SessionConfig{}, false},
+		{"Isolation", "sqlserver", SessionConfig{Isolation: "snapshot"}, false},
+		{"Oracle", "godror", SessionConfig{Statements: []string{"ALTER SESSION SET ddl_lock_timeout = {{timeout_seconds}}"}}, false},
+		{"UnknownDriver", "oracle", SessionConfig{}, true},
+		{"UnknownIsolation", "mysql", SessionConfig{Isolation: "dirty"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.Validate(tt.driver); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSQLClient_sessionQuery(t *testing.T) {
+	db, fake := newFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		if strings.HasPrefix(query, "SET LOCK_TIMEOUT") {
+			return fakeResult{}
+		}
+		return fakeResult{columns: []string{"broker_id"}, rows: [][]driver.Value{{int64(1)}, {int64(2)}}}
+	})
+	s := newTestSQLClient("sqlserver", "", "dbo", time.Second)
+	s.db = db
+	s.session = newSession(s.dialect, 5*time.Second, nil)
+
+	ids, err := s.brokerIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(ids, []int{1, 2}); diff != nil {
+		t.Errorf("brokerIDs() = %v: %s", ids, diff)
+	}
+	queries := []string{}
+	for _, q := range fake.Queries() {
+		queries = append(queries, q.query)
+	}
+	if diff := deep.Equal(queries, []string{"SET LOCK_TIMEOUT 5000", s.queries[brokersQuery]}); diff != nil {
+		t.Errorf("queries = %v: %s", queries, diff)
+	}
+	wantTxs := []driver.TxOptions{{Isolation: driver.IsolationLevel(sql.LevelReadCommitted)}}
+	if diff := deep.Equal(fake.Transactions(), wantTxs); diff != nil {
+		t.Errorf("transactions = %+v: %s", fake.Transactions(), diff)
+	}
+}
+
+func TestSQLClient_sessionQueryReset(t *testing.T) {
+	db, fake := newFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		if strings.HasPrefix(query, "SET") {
+			return fakeResult{}
+		}
+		return fakeResult{columns: []string{"broker_id"}, rows: [][]driver.Value{{int64(1)}}}
+	})
+	s := newTestSQLClient("mysql", "", "reporting", time.Second)
+	s.db = db
+	s.session = newSession(s.dialect, 5*time.Second, nil)
+
+	if _, err := s.brokerIDs(); err != nil {
+		t.Fatal(err)
+	}
+	// The session setting is reset before the connection is returned to the pool.
+	queries := []string{}
+	for _, q := range fake.Queries() {
+		queries = append(queries, q.query)
+	}
+	want := []string{"SET SESSION max_execution_time = 5000", s.queries[brokersQuery], "SET SESSION max_execution_time = DEFAULT"}
+	if diff := deep.Equal(queries, want); diff != nil {
+		t.Errorf("queries = %v: %s", queries, diff)
+	}
+}
+
+func TestSQLClient_sessionQueryFailure(t *testing.T) {
+	db, fake := newFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		if strings.HasPrefix(query, "SET") {
+			return fakeResult{err: fmt.Errorf("permission denied")}
+		}
+		return fakeResult{columns: []string{"broker_id"}}
+	})
+	s := newTestSQLClient("postgres", "", "public", time.Second)
+	s.db = db
+	s.session = newSession(s.dialect, 5*time.Second, nil)
+
+	_, err := s.brokerIDs()
+	if err == nil || !strings.Contains(err.Error(), "session statement failed") {
+		t.Errorf("brokerIDs() error = %v, want session statement failed", err)
+	}
+	// The query is not run if the session settings cannot be applied.
+	if expect, got := 1, len(fake.Queries()); expect != got {
+		t.Errorf("expected %d queries, got %d", expect, got)
+	}
+}
+
+// TestSQLClient_sessionQuerySQLite runs the queries in read-only transactions on a SQLite fixture file.
+func TestSQLClient_sessionQuerySQLite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "reporting.db")
+
+	fixture, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statements := []string{
+		"CREATE TABLE brokers (broker_id INTEGER)",
+		"INSERT INTO brokers VALUES (1)",
+		"INSERT INTO brokers VALUES (3)",
+	}
+	for _, statement := range statements {
+		if _, err := fixture.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fixture.Close()
+
+	s, err := NewSQLClient("sqlite://"+path, Credentials{}, "", time.Second, SQLOptions{ReadOnly: true, StatementTimeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.db.Close()
+	// More queries than connections, so that a transaction left open would block.
+	s.db.SetMaxOpenConns(1)
+	for i := 0; i < 3; i++ {
+		ids, err := s.brokerIDs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := deep.Equal(ids, []int{1, 3}); diff != nil {
+			t.Errorf("brokerIDs() = %v: %s", ids, diff)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"encoding/xml"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/http/httptrace"
@@ -16,8 +17,10 @@ import (
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/version"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http/httpproxy"
 )
 
 const (
@@ -186,6 +189,24 @@ func (f *SOAPFault) Error() string {
 	return f.String
 }
 
+// retryableError marks a failure that may not recur if the call is repeated e.g. a dropped connection.
+type retryableError struct {
+	error
+}
+
+// SOAPOptions holds the optional settings for the SOAP client.
+type SOAPOptions struct {
+	Retries          int           // Number of times a failed call is retried
+	RetryBackoff     time.Duration // Delay before the first retry, doubled for each subsequent retry
+	BreakerThreshold int           // Number of consecutive failures before a Broker is skipped, or 0 to never skip
+	BreakerCooldown  time.Duration // Time for which a Broker is skipped
+	TopologyTTL      time.Duration // Maximum age of the cached Broker list, or 0 to disable the cache and call the Director on every scrape
+	TopologyRefresh  time.Duration // Interval between background refreshes of the cached Broker list, at most half of TopologyTTL
+	ProxyURL         string        // Proxy for all calls, overriding the proxy environment variables
+	NoProxy          string        // Comma-separated hosts, domains and CIDRs that bypass ProxyURL
+	Headers          http.Header   // Extra headers added to every request
+}
+
 // SOAPClient is a custom SOAP client specific to GridServer Web Services.
 type SOAPClient struct {
 	URL          string
@@ -194,71 +215,171 @@ type SOAPClient struct {
 	TLSConfig    *tls.Config
 	Timeout      time.Duration
 	DirectorOnly bool
+	SOAPOptions
+	passwordFile *passwordFile // Only set if the password is read from a file
+	breakers     *brokerBreakers
+	topology     *topologyCache // Only set if the topology cache is enabled
+	topologyAge  prometheus.Gauge
 }
 
 // NewSOAPClient returns a new SOAPClient configured for accessing a GridServer Manager.
-func NewSOAPClient(uri string, tlsVerify bool, timeout time.Duration, directorOnly bool) (*SOAPClient, error) {
-	u, err := url.Parse(uri)
+// The credentials override any username and password in the URL.
+func NewSOAPClient(uri string, creds Credentials, tlsVerify bool, timeout time.Duration, directorOnly bool, opts SOAPOptions) (*SOAPClient, error) {
+	m, err := parseManagerURL(uri, creds, "http", "https")
 	if err != nil {
-		return nil, errors.Wrap(err, "invalid URL")
-	}
-	if u.Scheme != "http" && u.Scheme != "https" {
-		return nil, fmt.Errorf("unsupported scheme: %q", u.Scheme)
-	}
-	username := u.User.Username()
-	if len(username) == 0 {
-		return nil, fmt.Errorf("username not set")
-	}
-	password, set := u.User.Password()
-	if !set {
-		return nil, fmt.Errorf("password not set")
+		return nil, err
 	}
-	if len(u.Hostname()) == 0 {
-		return nil, fmt.Errorf("hostname not set")
-	}
-	port := defaultPort
-	if len(u.Port()) > 0 {
-		intPort, err := strconv.Atoi(u.Port())
-		if err != nil || 0 > intPort || intPort > 65535 {
-			return nil, fmt.Errorf("invalid port: %q", u.Port())
-		}
-		port = strconv.Itoa(intPort)
+	httpClient, tlsCfg, err := newHTTPClient(tlsVerify, timeout, opts.ProxyURL, opts.NoProxy)
+	if err != nil {
+		return nil, err
 	}
+	client = httpClient
 
 	director := &url.URL{
-		Scheme: u.Scheme,
-		Host:   net.JoinHostPort(u.Hostname(), port),
-		Path:   cleanPath(u.Path),
-	}
-	tlsCfg := &tls.Config{
-		InsecureSkipVerify: !tlsVerify,
-	}
-	tr := &http.Transport{
-		TLSClientConfig: tlsCfg,
-		DialContext: (&net.Dialer{
-			Timeout: timeout, // Use the user-specified timeout for the connection timeout
-		}).DialContext,
-		Proxy:                 http.ProxyFromEnvironment,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       30 * time.Second, // Force idle connections to time out between scrapes
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-	}
-	client = &http.Client{
-		Transport: tr,
-		Timeout:   timeout + 10*time.Millisecond, // Ensure connection timeout fires before request timeout
-	}
-
-	return &SOAPClient{
+		Scheme: m.Scheme,
+		Host:   m.Host,
+		Path:   cleanPath(m.Path),
+	}
+	s := &SOAPClient{
 		URL:          director.String(),
-		Username:     username,
-		Password:     password,
+		Username:     m.Username,
+		Password:     m.Password,
 		TLSConfig:    tlsCfg,
 		Timeout:      timeout,
 		DirectorOnly: directorOnly,
+		SOAPOptions:  opts,
+		passwordFile: m.passwordFile,
+		breakers:     newBrokerBreakers(opts.BreakerThreshold, opts.BreakerCooldown),
+	}
+	// The Director is called on every scrape in Director only mode, so the Broker list is not cached.
+	if opts.TopologyTTL > 0 && !directorOnly {
+		interval := opts.TopologyRefresh
+		if interval <= 0 || interval > opts.TopologyTTL/2 {
+			interval = opts.TopologyTTL / 2
+		}
+		s.topology = newTopologyCache(opts.TopologyTTL)
+		s.topologyAge = prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "exporter_topology_age_seconds",
+			Help:      "Time since the cached Broker list was last refreshed from the Director.",
+		})
+		s.topology.Start(interval, s.refreshTopology)
+	}
+	return s, nil
+}
+
+// Close stops the background refresh of the cached Broker list, if any.
+func (s *SOAPClient) Close() error {
+	if s.topology != nil {
+		s.topology.Stop()
+	}
+	return nil
+}
+
+// refreshTopology retrieves the Broker list from the Director for the topology cache.
+func (s *SOAPClient) refreshTopology() ([]*BrokerInfo, error) {
+	director, _ := url.Parse(s.URL)
+	brokerInfos, elapsed, err := s.GetAllBrokerInfo()
+	if err != nil {
+		log.WithField("elapsed", elapsed).
+			WithField("hostname", director.Hostname()).
+			WithField("age", s.topology.Age(time.Now()).Round(time.Second)).
+			WithField("error", err).
+			Warn("Broker list refresh failed, using cached Broker list")
+		return nil, err
+	}
+	log.WithField("elapsed", elapsed).WithField("hostname", director.Hostname()).WithField("brokers", len(brokerInfos)).Debug("Broker list refresh succeeded")
+	return brokerInfos, nil
+}
+
+// Describe describes the metrics reported by the SOAP client itself. It implements prometheus.Collector.
+func (s *SOAPClient) Describe(ch chan<- *prometheus.Desc) {
+	s.breakers.states.Describe(ch)
+	if s.topology != nil {
+		ch <- s.topologyAge.Desc()
+	}
+}
+
+// Collect delivers the metrics reported by the SOAP client itself. It implements prometheus.Collector.
+func (s *SOAPClient) Collect(ch chan<- prometheus.Metric) {
+	s.breakers.states.Collect(ch)
+	if s.topology != nil {
+		if age := s.topology.Age(time.Now()); age >= 0 {
+			s.topologyAge.Set(age.Seconds())
+			ch <- s.topologyAge
+		}
+	}
+}
+
+// proxyFunc returns the proxy selection function for the HTTP transport. If no proxy URL is supplied,
+// the proxy environment variables are used. Credentials for the proxy may be included in the URL.
+func proxyFunc(proxyURL string, noProxy string) (func(*http.Request) (*url.URL, error), error) {
+	if proxyURL == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid proxy URL")
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme: %q", u.Scheme)
+	}
+	if len(u.Hostname()) == 0 {
+		return nil, fmt.Errorf("proxy hostname not set")
+	}
+
+	cfg := &httpproxy.Config{
+		HTTPProxy:  proxyURL,
+		HTTPSProxy: proxyURL,
+		NoProxy:    noProxy,
+	}
+	proxy := cfg.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxy(req.URL)
 	}, nil
 }
 
+// reservedHeaders are set by the SOAP and REST clients, so they cannot be set as extra headers.
+var reservedHeaders = map[string]bool{
+	"Accept":         true,
+	"Authorization":  true,
+	"Content-Length": true,
+	"Content-Type":   true,
+	"Host":           true,
+	"Soapaction":     true,
+	"User-Agent":     true,
+}
+
+// ParseHeaders converts a list of headers in "Name: value" format into an http.Header.
+func ParseHeaders(headers []string) (http.Header, error) {
+	h := http.Header{}
+	for _, header := range headers {
+		i := strings.IndexByte(header, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid header: %q", header)
+		}
+		name := strings.TrimSpace(header[:i])
+		if err := ValidateHeaderName(name); err != nil {
+			return nil, err
+		}
+		h.Add(name, strings.TrimSpace(header[i+1:]))
+	}
+	return h, nil
+}
+
+// ValidateHeaderName checks that an extra header name is well formed and not set by the clients themselves.
+func ValidateHeaderName(name string) error {
+	if len(name) == 0 || strings.ContainsAny(name, " \t") {
+		return fmt.Errorf("invalid header name: %q", name)
+	}
+	if reservedHeaders[http.CanonicalHeaderKey(name)] {
+		return fmt.Errorf("reserved header name: %q", name)
+	}
+	return nil
+}
+
 // cleanPath attempts to clean up the supplied path.
 func cleanPath(path string) string {
 	trimmed := strings.Trim(path, "/")
@@ -268,8 +389,44 @@ func cleanPath(path string) string {
 	return strings.TrimRight(path, "/")
 }
 
-// Call calls the requested operation.
+// callWithRetries calls fn, retrying failures marked as retryable with jittered exponential backoff.
+// Retries stop once the timeout would be exceeded.
+func callWithRetries(retries int, backoff time.Duration, timeout time.Duration, logger *log.Entry, fn func() error) error {
+	deadline := time.Now().Add(timeout)
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		retryable, ok := err.(*retryableError)
+		if !ok {
+			return err
+		}
+		if attempt > retries {
+			return retryable.error
+		}
+
+		// Sleep for between half and all of the backoff period, unless that would exceed the timeout.
+		delay := backoff / 2
+		if backoff > 1 {
+			delay += time.Duration(rand.Int63n(int64(backoff / 2)))
+		}
+		if timeout > 0 && time.Now().Add(delay).After(deadline) {
+			return retryable.error
+		}
+		logger.WithField("attempt", attempt).WithField("delay", delay).WithField("error", retryable.error).Debug("Call failed, retrying")
+		time.Sleep(delay)
+		backoff *= 2
+	}
+}
+
+// Call calls the requested operation. All operations used by the exporter are read-only, so calls
+// failing due to network errors are retried with jittered exponential backoff, within the timeout.
 func (s *SOAPClient) Call(endpoint string, request, response interface{}) error {
+	return callWithRetries(s.Retries, s.RetryBackoff, s.Timeout, log.WithField("url", endpoint), func() error {
+		return s.call(endpoint, request, response)
+	})
+}
+
+// call makes a single attempt at calling the requested operation.
+func (s *SOAPClient) call(endpoint string, request, response interface{}) error {
 	// Create SOAP request envelope.
 	envelope := SOAPEnvelope{}
 	envelope.Body.Content = request
@@ -292,9 +449,21 @@ func (s *SOAPClient) Call(endpoint string, request, response interface{}) error
 		log.WithField("error", err).WithField("request", reqXML).WithField("url", endpoint).Debug("HTTP request creation failed")
 		return errors.Wrap(err, "HTTP request creation failed")
 	}
-	req.SetBasicAuth(s.Username, s.Password)
-	req.Header.Add("Content-Type", "text/xml; charset=\"utf-8\"")
-	req.Header.Add("SOAPAction", "")
+	password := s.Password
+	if s.passwordFile != nil {
+		password, _, err = s.passwordFile.Read()
+		if err != nil {
+			log.WithField("error", err).WithField("path", s.passwordFile.path).Debug("Password file read failed")
+			return err
+		}
+	}
+	// The extra headers are added first, so that they cannot override the headers of the call.
+	for name, values := range s.Headers {
+		req.Header[name] = values
+	}
+	req.SetBasicAuth(s.Username, password)
+	req.Header.Set("Content-Type", "text/xml; charset=\"utf-8\"")
+	req.Header.Set("SOAPAction", "")
 	req.Header.Set("User-Agent", "gridserver-exporter/"+version.Version)
 	req.Close = false
 
@@ -376,7 +545,7 @@ func (s *SOAPClient) Call(endpoint string, request, response interface{}) error
 			}
 		}
 		contextLogger.Debug("HTTP request failed")
-		return errors.Wrap(err, "HTTP request failed")
+		return &retryableError{errors.Wrap(err, "HTTP request failed")}
 	}
 	defer res.Body.Close()
 
@@ -384,12 +553,19 @@ func (s *SOAPClient) Call(endpoint string, request, response interface{}) error
 	rawbody, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		log.WithField("error", err).WithField("request", reqXML).WithField("response", string(rawbody)).WithField("url", endpoint).Debug("HTTP response body read failed")
-		return errors.Wrap(err, "HTTP response body read failed")
+		return &retryableError{errors.Wrap(err, "HTTP response body read failed")}
 	}
 	if len(rawbody) == 0 {
 		return fmt.Errorf("received empty response from server")
 	}
 
+	// Gateway errors from proxies or load balancers are usually transient, and do not contain SOAP responses.
+	switch res.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		log.WithField("status", res.Status).WithField("request", reqXML).WithField("response", string(rawbody)).WithField("url", endpoint).Debug("Received gateway error")
+		return &retryableError{fmt.Errorf("received gateway error: %s", res.Status)}
+	}
+
 	log.WithField("response", string(rawbody)).WithField("status", res.Status).Trace("SOAP response received")
 
 	// Parse SOAP response envelope.
@@ -460,6 +636,48 @@ func (s *SOAPClient) GetPendingInvocationCount(endpoint string) (int, time.Durat
 	return response.GetPendingInvocationCountReturn, elapsed, nil
 }
 
+// fetchBroker retrieves the per-Broker metrics from the ServiceAdmin service of a Broker.
+func (s *SOAPClient) fetchBroker(broker *BrokerReport, baseURL string) error {
+	var elapsed time.Duration
+	var err error
+	endpoint := baseURL + "/webservices/ServiceAdmin"
+
+	broker.ServicesRunning, elapsed, err = s.GetRunningServiceCount(endpoint)
+	if err != nil {
+		log.WithField("elapsed", elapsed).WithField("hostname", broker.Hostname).WithField("name", broker.Name).WithField("error", err).Debug("ServiceAdmin.getRunningServiceCount failed")
+		return errors.Wrap(err, "ServiceAdmin.getRunningServiceCount failed")
+	}
+	log.WithField("elapsed", elapsed).
+		WithField("hostname", broker.Hostname).
+		WithField("name", broker.Name).
+		WithField("servicesRunning", broker.ServicesRunning).
+		Debug("ServiceAdmin.getRunningServiceCount succeeded")
+
+	broker.TasksRunning, elapsed, err = s.GetRunningInvocationCount(endpoint)
+	if err != nil {
+		log.WithField("elapsed", elapsed).WithField("hostname", broker.Hostname).WithField("name", broker.Name).WithField("error", err).Debug("ServiceAdmin.getRunningInvocationCount failed")
+		return errors.Wrap(err, "ServiceAdmin.getRunningInvocationCount failed")
+	}
+	log.WithField("elapsed", elapsed).
+		WithField("hostname", broker.Hostname).
+		WithField("name", broker.Name).
+		WithField("tasksRunning", broker.TasksRunning).
+		Debug("ServiceAdmin.getRunningInvocationCount succeeded")
+
+	broker.TasksPending, elapsed, err = s.GetPendingInvocationCount(endpoint)
+	if err != nil {
+		log.WithField("elapsed", elapsed).WithField("hostname", broker.Hostname).WithField("name", broker.Name).WithField("error", err).Debug("ServiceAdmin.getPendingInvocationCount failed")
+		return errors.Wrap(err, "ServiceAdmin.getPendingInvocationCount failed")
+	}
+	log.WithField("elapsed", elapsed).
+		WithField("hostname", broker.Hostname).
+		WithField("name", broker.Name).
+		WithField("tasksPending", broker.TasksPending).
+		Debug("ServiceAdmin.getPendingInvocationCount succeeded")
+
+	return nil
+}
+
 // Fetch retrieves the most recent Broker and grid reports from the Web Services API.
 func (s *SOAPClient) Fetch() func() (GridReport, []BrokerReport, error) {
 	return func() (GridReport, []BrokerReport, error) {
@@ -468,17 +686,41 @@ func (s *SOAPClient) Fetch() func() (GridReport, []BrokerReport, error) {
 		director, _ := url.Parse(s.URL)
 		hostname := director.Hostname()
 
-		// Get the Brokers and their basic metrics from the Director.
-		brokerInfos, elapsed, err := s.GetAllBrokerInfo()
-		if err != nil {
-			log.WithField("elapsed", elapsed).WithField("hostname", hostname).WithField("error", err).Debug("BrokerAdmin.getAllBrokerInfo failed")
-			return grid, nil, errors.Wrap(err, "BrokerAdmin.getAllBrokerInfo failed")
+		// Get the Brokers and their basic metrics from the cached Broker list while it is fresh, so that the
+		// Director is not called on every scrape, or from the Director otherwise.
+		// If the last background refresh failed, the per-Broker metrics are still collected from the cached list,
+		// but the Engine and Driver counts are not reported, as they are only available from the Director.
+		var brokerInfos []*BrokerInfo
+		var elapsed time.Duration
+		var err error
+		directorUp := true
+		cached := false
+		if s.topology != nil {
+			var age time.Duration
+			brokerInfos, age, cached = s.topology.Get(time.Now())
+			if cached {
+				directorUp = s.topology.DirectorUp()
+				log.WithField("age", age.Round(time.Second)).WithField("hostname", hostname).WithField("brokers", len(brokerInfos)).WithField("directorUp", directorUp).Debug("Using cached Broker list")
+			}
+		}
+		if !cached {
+			brokerInfos, elapsed, err = s.GetAllBrokerInfo()
+			if err != nil {
+				log.WithField("elapsed", elapsed).WithField("hostname", hostname).WithField("error", err).Debug("BrokerAdmin.getAllBrokerInfo failed")
+				return grid, nil, errors.Wrap(err, "BrokerAdmin.getAllBrokerInfo failed")
+			}
+			log.WithField("elapsed", elapsed).WithField("hostname", hostname).WithField("brokers", len(brokerInfos)).Debug("BrokerAdmin.getAllBrokerInfo succeeded")
+			if s.topology != nil {
+				s.topology.Set(brokerInfos, time.Now())
+			}
 		}
-		log.WithField("elapsed", elapsed).WithField("hostname", hostname).WithField("brokers", len(brokerInfos)).Debug("BrokerAdmin.getAllBrokerInfo succeeded")
 
+		s.breakers.Begin()
 		for _, brokerInfo := range brokerInfos {
 			baseURL, _ := url.Parse(brokerInfo.BaseURL)
 			broker := BrokerReport{
+				ID:              strconv.FormatInt(brokerInfo.BrokerID, 10),
+				URL:             brokerInfo.BaseURL,
 				Name:            brokerInfo.Name,
 				Hostname:        baseURL.Hostname(),
 				BusyEngines:     brokerInfo.BusyEngineCount,
@@ -489,61 +731,53 @@ func (s *SOAPClient) Fetch() func() (GridReport, []BrokerReport, error) {
 				TasksPending:    -1,
 				UptimeMinutes:   -1,
 			}
+			if !directorUp {
+				broker.BusyEngines = -1
+				broker.TotalEngines = -1
+				broker.Drivers = -1
+			}
 
-			// If not operating in Director only mode, collect the per-Broker metrics.
+			// If not operating in Director only mode, collect the per-Broker metrics unless the Broker is being skipped.
+			// The remaining Brokers are still called after a failure, so that every circuit breaker is kept up to date.
 			if !s.DirectorOnly {
-				endpoint := brokerInfo.BaseURL + "/webservices/ServiceAdmin"
-
-				broker.ServicesRunning, elapsed, err = s.GetRunningServiceCount(endpoint)
-				if err != nil {
-					log.WithField("elapsed", elapsed).WithField("hostname", broker.Hostname).WithField("name", broker.Name).WithField("error", err).Debug("ServiceAdmin.getRunningServiceCount failed")
-					return grid, nil, errors.Wrap(err, "ServiceAdmin.getRunningServiceCount failed")
-				}
-				log.WithField("elapsed", elapsed).
-					WithField("hostname", broker.Hostname).
-					WithField("name", broker.Name).
-					WithField("servicesRunning", broker.ServicesRunning).
-					Debug("ServiceAdmin.getRunningServiceCount succeeded")
-
-				broker.TasksRunning, elapsed, err = s.GetRunningInvocationCount(endpoint)
-				if err != nil {
-					log.WithField("elapsed", elapsed).WithField("hostname", broker.Hostname).WithField("name", broker.Name).WithField("error", err).Debug("ServiceAdmin.getRunningInvocationCount failed")
-					return grid, nil, errors.Wrap(err, "ServiceAdmin.getRunningInvocationCount failed")
-				}
-				log.WithField("elapsed", elapsed).
-					WithField("hostname", broker.Hostname).
-					WithField("name", broker.Name).
-					WithField("tasksRunning", broker.TasksRunning).
-					Debug("ServiceAdmin.getRunningInvocationCount succeeded")
-
-				broker.TasksPending, elapsed, err = s.GetPendingInvocationCount(endpoint)
-				if err != nil {
-					log.WithField("elapsed", elapsed).WithField("hostname", broker.Hostname).WithField("name", broker.Name).WithField("error", err).Debug("ServiceAdmin.getPendingInvocationCount failed")
-					return grid, nil, errors.Wrap(err, "ServiceAdmin.getPendingInvocationCount failed")
-				}
-				log.WithField("elapsed", elapsed).
-					WithField("hostname", broker.Hostname).
-					WithField("name", broker.Name).
-					WithField("tasksPending", broker.TasksPending).
-					Debug("ServiceAdmin.getPendingInvocationCount succeeded")
+				s.breakers.Call(&broker, func() error {
+					return s.fetchBroker(&broker, brokerInfo.BaseURL)
+				})
 			}
 
 			brokers = append(brokers, broker)
 		}
+		s.breakers.End()
 
 		// Sum the individual broker reports to calculate a whole grid report.
+		// Brokers that failed or were skipped by their circuit breakers do not contribute per-Broker metrics.
+		if !directorUp {
+			grid.BusyEngines = -1
+			grid.TotalEngines = -1
+			grid.Drivers = -1
+		}
+		reported := false
 		for _, broker := range brokers {
-			grid.BusyEngines += broker.BusyEngines
-			grid.TotalEngines += broker.TotalEngines
-			grid.Drivers += broker.Drivers
+			if directorUp {
+				grid.BusyEngines += broker.BusyEngines
+				grid.TotalEngines += broker.TotalEngines
+				grid.Drivers += broker.Drivers
+			}
 
 			// If not operating in Director only mode, use the per-Broker metrics.
-			if !s.DirectorOnly {
+			if !s.DirectorOnly && broker.ServicesRunning >= 0 {
 				grid.ServicesRunning += broker.ServicesRunning
 				grid.TasksRunning += broker.TasksRunning
 				grid.TasksPending += broker.TasksPending
+				reported = true
 			}
 		}
+		// If no Broker reported, the per-Broker totals are unknown rather than 0.
+		if !s.DirectorOnly && !reported && len(brokers) > 0 {
+			grid.ServicesRunning = -1
+			grid.TasksRunning = -1
+			grid.TasksPending = -1
+		}
 
 		// If operating in Director only mode, the following metrics will not have been obtained from the Brokers,
 		// but they can be obtained at the grid level from the Director.
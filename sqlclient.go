@@ -1,79 +1,268 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"net"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	_ "github.com/denisenkom/go-mssqldb"
-	_ "github.com/godror/godror"
+	"github.com/go-sql-driver/mysql"
+	"github.com/godror/godror"
 	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
 
-const (
-	queryTmpl = `
-		WITH latest AS (
-			SELECT
-				broker_id,
-				MAX(time_stamp) AS max_time_stamp
-			FROM %[1]s.broker_stats
-			GROUP BY broker_id )
-		SELECT
-			latest.broker_id,
-			brokers.broker_url,
-			brokers.broker_name,
-			broker_stats.num_busy_engines,
-			broker_stats.num_total_engines,
-			broker_stats.num_drivers,
-			broker_stats.uptime_minutes,
-			broker_stats.num_jobs_running,
-			broker_stats.num_tasks_pending,
-			latest.max_time_stamp AS time_stamp
-		FROM latest
-		INNER JOIN %[1]s.broker_stats ON %[1]s.broker_stats.broker_id = latest.broker_id
-			AND %[1]s.broker_stats.time_stamp = latest.max_time_stamp
-		INNER JOIN %[1]s.brokers ON %[1]s.brokers.broker_id = latest.broker_id
-		`
-)
+// SQLOptions holds the settings specific to the reporting database.
+type SQLOptions struct {
+	QueryWindow          time.Duration            // Only consider reports within this period for the latest report query, if greater than 0
+	StaleThreshold       time.Duration            // Exclude Brokers with older reports from the grid report, if greater than 0
+	EngineEvents         bool                     // Count the Engine events
+	ServiceEvents        bool                     // Count the Service (job) and task events
+	StateFile            string                   // Persist the event watermarks in this file, if set
+	Queries              []QueryConfig            // User-defined queries
+	MaxOpenConns         int                      // Maximum number of open connections, if greater than 0
+	MaxIdleConns         int                      // Maximum number of idle connections, none if 0 or less
+	ConnMaxLifetime      time.Duration            // Close connections after this period, if greater than 0
+	TimeZone             string                   // Time zone of the timestamps (or "auto" to detect it), if set
+	AggregateWindow      time.Duration            // Aggregate the reports within this period, if greater than 0
+	EngineSeconds        bool                     // Count the Engine time consumed by tasks
+	DriverEvents         bool                     // Count the Driver logins
+	ServiceSubmissions   bool                     // Count the Service submissions and observe the queue wait times
+	ReadOnly             bool                     // Run the queries in read-only transactions with the session settings
+	StatementTimeout     time.Duration            // Limit the queries in read-only transactions to this period, if greater than 0
+	PrepareStatements    bool                     // Prepare the fixed queries once per connection, and log their plans at startup
+	Sessions             map[string]SessionConfig // Overrides of the read-only transaction settings, by driver
+	HousekeepingInterval time.Duration            // Read the row counts and timestamp ranges of the tables at this interval, if greater than 0
+}
 
 // SQLClient is a custom SQL client specific to the GridServer reporting database.
 type SQLClient struct {
 	Driver  string
 	DSN     string
 	Schema  string
-	Timeout time.Duration // Currently ignored - relying on the default timeouts in the driver instead
-	db      *sql.DB
+	Timeout time.Duration // Only used for user-defined queries - relying on the default timeouts in the driver otherwise
+	SQLOptions
+	dbMutex       sync.RWMutex
+	db            *sql.DB // Replaced when the password changes, so only read with database()
+	dialect       dialect
+	quotedSchema  string
+	queries       map[string]string // The queries with the schema inserted, by name
+	queryDuration *prometheus.GaugeVec
+	queryRows     *prometheus.GaugeVec
+	dbStats       *dbStatsCollector
+	session       *session // Only set if the queries run in read-only transactions
+	events        []eventCollector
+	housekeeping  *housekeepingCollector // Only set if the tables are read for housekeeping
+	state         *stateFile             // Only set if the event watermarks are persisted
+	customQueries []*customQuery
+	customSuccess *prometheus.GaugeVec // Only set if there are user-defined queries
+	locationMutex sync.RWMutex
+	location      *time.Location // Only set if the timestamps are converted from a database time zone. Guarded by locationMutex.
+	url           *url.URL       // Only set if the password is read from a file, to rebuild the DSN. Guarded by dbMutex.
+	passwordFile  *passwordFile  // Only set if the password is read from a file
+
+	statementsMutex sync.Mutex
+	statements      map[string]*sql.Stmt // Prepared statements of the fixed queries, by name
+	statementsDB    *sql.DB              // The database the statements were prepared on
 }
 
+// Names of the queries, used in logs and the query duration metric labels.
+const (
+	brokersQuery    = "brokers"
+	latestQuery     = "latest"
+	windowQuery     = "latest_window"
+	fallbackQuery   = "latest_fallback"
+	timeZoneQuery   = "time_zone"
+	aggregateQuery  = "aggregates"
+	backfillQuery   = "backfill"
+	chargebackQuery = "chargeback"
+)
+
 // NewSQLClient returns a new SQLClient configured for accessing a GridServer reporting database.
-func NewSQLClient(uri string, schema string, timeout time.Duration) (*SQLClient, error) {
+// The credentials override any username and password in the URL.
+func NewSQLClient(uri string, creds Credentials, schema string, timeout time.Duration, opts SQLOptions) (*SQLClient, error) {
 	u, err := url.Parse(uri)
 	if err != nil {
 		return nil, errors.Wrap(err, "invalid URL")
 	}
-	username := u.User.Username()
-	if len(username) == 0 {
-		return nil, fmt.Errorf("username not set")
+	var passwordFile *passwordFile
+	if u.Scheme != "sqlite" { // SQLite databases are files, without a server or credentials
+		externalAuth, err := oracleExternalAuth(u)
+		if err != nil {
+			return nil, err
+		}
+		if !externalAuth {
+			var username, password string
+			username, password, passwordFile, err = creds.Resolve(u.User)
+			if err != nil {
+				return nil, err
+			}
+			u.User = url.UserPassword(username, password)
+		}
+		if len(u.Hostname()) == 0 {
+			return nil, fmt.Errorf("hostname not set")
+		}
+		if len(u.Port()) > 0 {
+			intPort, err := strconv.Atoi(u.Port())
+			if err != nil || 0 > intPort || intPort > 65535 {
+				return nil, fmt.Errorf("invalid port: %q", u.Port())
+			}
+		}
+	}
+
+	driver, dsn, schema, err := dataSource(u, schema)
+	if err != nil {
+		return nil, err
+	}
+
+	dialect, err := dialectFor(driver)
+	if err != nil {
+		return nil, err
 	}
-	_, set := u.User.Password()
-	if !set {
-		return nil, fmt.Errorf("password not set")
+	if u.Scheme == "mariadb" {
+		dialect = mariadbDialect{}
 	}
-	if len(u.Hostname()) == 0 {
-		return nil, fmt.Errorf("hostname not set")
+	quotedSchema, err := dialect.QuoteIdentifier(schema)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid schema")
 	}
-	if len(u.Port()) > 0 {
-		intPort, err := strconv.Atoi(u.Port())
-		if err != nil || 0 > intPort || intPort > 65535 {
-			return nil, fmt.Errorf("invalid port: %q", u.Port())
+
+	s := &SQLClient{
+		Driver:        driver,
+		DSN:           dsn,
+		Schema:        schema,
+		Timeout:       timeout,
+		SQLOptions:    opts,
+		dialect:       dialect,
+		quotedSchema:  quotedSchema,
+		queries:       newQueries(dialect, quotedSchema),
+		queryDuration: newQueryDurationMetric(),
+		queryRows:     newQueryRowsMetric(),
+	}
+	s.location, err = loadTimeZone(opts.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+	s.db, err = s.open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	s.dbStats = newDBStatsCollector(func() sql.DBStats { return s.database().Stats() })
+	if opts.ReadOnly {
+		var config *SessionConfig
+		if c, ok := opts.Sessions[driver]; ok {
+			config = &c
 		}
+		s.session = newSession(dialect, opts.StatementTimeout, config)
 	}
+	if len(opts.StateFile) > 0 && (opts.EngineEvents || opts.ServiceEvents || opts.EngineSeconds || opts.DriverEvents || opts.ServiceSubmissions) {
+		s.state, err = loadStateFile(opts.StateFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := ValidateQueries(opts.Queries); err != nil {
+		return nil, err
+	}
+	for _, config := range opts.Queries {
+		s.customQueries = append(s.customQueries, newCustomQuery(config, quotedSchema))
+	}
+	if len(s.customQueries) > 0 {
+		s.customSuccess = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "exporter_custom_query_success",
+				Help:      "Was the last run of the user-defined query successful.",
+			},
+			[]string{"query"},
+		)
+	}
+	if opts.EngineEvents {
+		s.events = append(s.events, newEngineEventCollector(dialect, quotedSchema, s.state))
+	}
+	if opts.ServiceEvents {
+		s.events = append(s.events, newJobEventCollector(dialect, quotedSchema, s.state), newTaskEventCollector(dialect, quotedSchema, s.state))
+	}
+	if opts.EngineSeconds {
+		s.events = append(s.events, newEngineSecondsCollector(dialect, quotedSchema, s.state))
+	}
+	if opts.DriverEvents {
+		s.events = append(s.events, newDriverLoginCollector(dialect, quotedSchema, s.state, s.fromDatabaseTime))
+	}
+	if opts.ServiceSubmissions {
+		s.events = append(s.events, newJobSubmissionCollector(dialect, quotedSchema, s.state), newQueueWaitCollector(dialect, quotedSchema, s.state))
+	}
+	if opts.HousekeepingInterval > 0 {
+		s.housekeeping = newHousekeepingCollector(dialect, quotedSchema, opts.HousekeepingInterval, s.fromDatabaseTime)
+	}
+	if passwordFile != nil {
+		s.url = u
+		s.passwordFile = passwordFile
+	}
+	return s, nil
+}
 
+// newQueries returns the fixed queries for a dialect and quoted schema.
+func newQueries(d dialect, schema string) map[string]string {
+	return map[string]string{
+		brokersQuery:    compact(d.BrokerIDsQuery(schema)),
+		latestQuery:     compact(d.LatestQuery(schema, "")),
+		windowQuery:     compact(d.LatestQuery(schema, "broker_stats.time_stamp >= "+d.Placeholder(1))),
+		timeZoneQuery:   d.TimeZoneOffsetQuery(),
+		backfillQuery:   newBackfillQuery(d, schema),
+		chargebackQuery: newChargebackQuery(d, schema),
+		aggregateQuery: compact(fmt.Sprintf(`
+			SELECT
+				broker_stats.broker_id,
+				MAX(broker_stats.num_busy_engines),
+				AVG(broker_stats.num_busy_engines * 1.0),
+				MAX(broker_stats.num_tasks_pending),
+				MIN(broker_stats.num_total_engines)
+			FROM %s
+			WHERE broker_stats.time_stamp >= %s
+			GROUP BY broker_stats.broker_id`, d.FromTable(schema, "broker_stats"), d.Placeholder(1))),
+	}
+}
+
+// compact removes the line breaks and tabs from a query for logs.
+func compact(query string) string {
+	return strings.Join(strings.Fields(query), " ")
+}
+
+func newQueryDurationMetric() *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "exporter_sql_query_duration_seconds",
+			Help:      "Duration of the most recent execution of each reporting database query.",
+		},
+		[]string{"query"},
+	)
+}
+
+func newQueryRowsMetric() *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "exporter_sql_query_rows",
+			Help:      "Number of rows read by the most recent execution of each reporting database query.",
+		},
+		[]string{"query"},
+	)
+}
+
+// dataSource returns the driver name and DSN for a database URL, and the schema name (which defaults per database).
+func dataSource(u *url.URL, schema string) (string, string, string, error) {
 	var driver string
 	var dsn string
 	switch u.Scheme {
@@ -95,27 +284,545 @@ func NewSQLClient(uri string, schema string, timeout time.Duration) (*SQLClient,
 		if len(schema) == 0 {
 			schema = u.User.Username() // Default schema on Oracle is the username
 		}
+		if len(schema) == 0 {
+			return "", "", "", fmt.Errorf("schema not set")
+		}
 		driver = "godror"
-		// Oracle DSNs look like: user/pass@host:port/sid - note the first slash
-		password, _ := u.User.Password()
-		dsn = fmt.Sprintf("%s/%s@%s:%s%s", u.User.Username(), password, u.Hostname(), u.Port(), u.Path)
+		var err error
+		dsn, err = oracleDSN(u)
+		if err != nil {
+			return "", "", "", err
+		}
+	case "mysql", "mariadb":
+		database := strings.TrimPrefix(u.Path, "/")
+		if len(schema) == 0 {
+			schema = database // Default schema on MySQL is the database
+		}
+		if len(schema) == 0 {
+			return "", "", "", fmt.Errorf("database not set")
+		}
+		driver = "mysql"
+		// MySQL DSNs look like: user:pass@tcp(host:port)/database?param=value - the URL parameters are passed through
+		config := mysql.NewConfig()
+		if len(u.RawQuery) > 0 {
+			var err error
+			config, err = mysql.ParseDSN("/?" + u.RawQuery)
+			if err != nil {
+				return "", "", "", errors.Wrap(err, "invalid URL parameters")
+			}
+		}
+		config.User = u.User.Username()
+		config.Passwd, _ = u.User.Password()
+		config.Net = "tcp"
+		config.Addr = u.Host
+		if len(u.Port()) == 0 {
+			config.Addr = net.JoinHostPort(u.Hostname(), "3306")
+		}
+		config.DBName = database
+		config.ParseTime = true // Scan DATETIME and TIMESTAMP columns into time.Time
+		dsn = config.FormatDSN()
+	case "sqlite":
+		if len(schema) == 0 {
+			schema = "main" // Default schema on SQLite is the main database file
+		}
+		driver = "sqlite3"
+		// SQLite URLs look like: sqlite:///absolute/path or sqlite://relative/path - opened read-only unless a mode is set
+		params := u.Query()
+		if len(params.Get("mode")) == 0 {
+			params.Set("mode", "ro")
+		}
+		dsn = "file:" + u.Host + u.Path + "?" + params.Encode()
 	default:
-		return nil, fmt.Errorf("unsupported scheme: %q", u.Scheme)
+		return "", "", "", fmt.Errorf("unsupported scheme: %q", u.Scheme)
+	}
+	return driver, dsn, schema, nil
+}
+
+// Oracle URL parameters used by the exporter. Any other parameters are passed through to godror.
+const (
+	oracleSIDParam          = "sid"             // Connect to the SID rather than the service name in the path
+	oracleWalletParam       = "wallet_location" // Directory of the wallet, set in the connect string
+	oracleExternalAuthParam = "external_auth"   // Authenticate with the OS user or wallet instead of a password
+)
+
+// oracleExternalAuth returns whether a URL is for Oracle with external authentication, which has no username or password.
+func oracleExternalAuth(u *url.URL) (bool, error) {
+	value := u.Query().Get(oracleExternalAuthParam)
+	if (u.Scheme != "ora" && u.Scheme != "oracle") || len(value) == 0 {
+		return false, nil
 	}
+	externalAuth, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s parameter: %q", oracleExternalAuthParam, value)
+	}
+	return externalAuth, nil
+}
 
-	db, err := sql.Open(driver, dsn)
+// oracleDSN returns the godror DSN for an Oracle URL. The host and path are an Easy Connect string (host:port/service),
+// or a TNS alias if there is only a host. Without driver parameters, the DSN looks like: user/pass@host:port/service -
+// note the first slash. Otherwise it is a URL with the parameters, which cannot include a SID connect descriptor.
+// The wallet location is set in the connect string, so it cannot be set for a TNS alias or with driver parameters.
+func oracleDSN(u *url.URL) (string, error) {
+	params := u.Query()
+	externalAuth, err := oracleExternalAuth(u)
 	if err != nil {
-		log.WithField("driver", driver).WithField("error", err).Debug("Database client creation failed")
+		return "", err
+	}
+	var username, password string
+	if !externalAuth {
+		username = u.User.Username()
+		password, _ = u.User.Password()
+	}
+
+	connect := u.Host + u.Path
+	if sid := params.Get(oracleSIDParam); len(sid) > 0 {
+		if len(strings.Trim(u.Path, "/")) > 0 {
+			return "", fmt.Errorf("both a service name and SID set")
+		}
+		port := u.Port()
+		if len(port) == 0 {
+			port = "1521"
+		}
+		security := ""
+		if wallet := params.Get(oracleWalletParam); len(wallet) > 0 {
+			security = fmt.Sprintf("(SECURITY=(MY_WALLET_DIRECTORY=%s))", wallet)
+		}
+		connect = fmt.Sprintf("(DESCRIPTION=(ADDRESS=(PROTOCOL=TCP)(HOST=%s)(PORT=%s))(CONNECT_DATA=(SID=%s))%s)", u.Hostname(), port, sid, security)
+	} else if wallet := params.Get(oracleWalletParam); len(wallet) > 0 {
+		if len(u.Port()) == 0 && len(strings.Trim(u.Path, "/")) == 0 {
+			return "", fmt.Errorf("%s cannot be used with a TNS alias, set it in the tnsnames.ora entry instead", oracleWalletParam)
+		}
+		connect += fmt.Sprintf("?%s=%s", oracleWalletParam, wallet) // An Easy Connect Plus parameter
+	}
+	for _, param := range []string{oracleSIDParam, oracleWalletParam, oracleExternalAuthParam} {
+		params.Del(param)
+	}
+	if len(params) == 0 {
+		return fmt.Sprintf("%s/%s@%s", username, password, connect), nil // An empty username and password use external authentication
+	}
+
+	if strings.HasPrefix(connect, "(") {
+		return "", fmt.Errorf("driver parameters cannot be used with a SID, use a TNS alias instead")
+	}
+	if len(u.Query().Get(oracleWalletParam)) > 0 {
+		return "", fmt.Errorf("driver parameters cannot be used with %s, use a TNS alias instead", oracleWalletParam)
+	}
+	dsn := &url.URL{Scheme: "oracle", Host: u.Host, Path: u.Path, RawQuery: params.Encode()}
+	if !externalAuth {
+		dsn.User = url.UserPassword(username, password)
+	}
+	if _, err := godror.ParseConnString(dsn.String()); err != nil {
+		return "", errors.Wrap(err, "invalid URL parameters")
+	}
+	return dsn.String(), nil
+}
+
+// open opens the database with a DSN, and configures the connection pool.
+func (s *SQLClient) open(dsn string) (*sql.DB, error) {
+	db, err := sql.Open(s.Driver, dsn)
+	if err != nil {
+		log.WithField("driver", s.Driver).WithField("error", err).Debug("Database client creation failed")
 		return nil, errors.Wrap(err, "database client creation failed")
 	}
+	db.SetMaxOpenConns(s.MaxOpenConns)
+	db.SetMaxIdleConns(s.MaxIdleConns)
+	db.SetConnMaxLifetime(s.ConnMaxLifetime)
+	return db, nil
+}
 
-	return &SQLClient{
-		Driver:  driver,
-		DSN:     dsn,
-		Schema:  schema,
-		Timeout: timeout,
-		db:      db,
-	}, nil
+// database returns the current database handle.
+func (s *SQLClient) database() *sql.DB {
+	s.dbMutex.RLock()
+	defer s.dbMutex.RUnlock()
+	return s.db
+}
+
+// refreshPassword re-reads the password file, and if the password differs from the one in use, reopens the
+// database with the new password. The client is only updated once the database is reopened, so a failure is
+// retried on the next call. Queries already running on the old handle finish before it is closed.
+func (s *SQLClient) refreshPassword() error {
+	password, _, err := s.passwordFile.Read()
+	if err != nil {
+		log.WithField("error", err).WithField("path", s.passwordFile.path).Debug("Password file read failed")
+		return err
+	}
+	s.dbMutex.RLock()
+	current, _ := s.url.User.Password()
+	u := *s.url
+	s.dbMutex.RUnlock()
+	if password == current {
+		return nil
+	}
+
+	u.User = url.UserPassword(u.User.Username(), password)
+	_, dsn, _, err := dataSource(&u, s.Schema)
+	if err != nil {
+		return err
+	}
+	db, err := s.open(dsn)
+	if err != nil {
+		return err
+	}
+	s.dbMutex.Lock()
+	old := s.db
+	s.db = db
+	s.url = &u
+	s.DSN = dsn
+	s.dbMutex.Unlock()
+	s.closeStatements()
+	old.Close()
+	log.WithField("path", s.passwordFile.path).Info("Password file changed, reconnecting to database")
+	return nil
+}
+
+// Describe describes the metrics reported by the SQL client itself. It implements prometheus.Collector.
+func (s *SQLClient) Describe(ch chan<- *prometheus.Desc) {
+	s.queryDuration.Describe(ch)
+	s.queryRows.Describe(ch)
+	s.dbStats.Describe(ch)
+	for _, c := range s.events {
+		c.Describe(ch)
+	}
+	if s.housekeeping != nil {
+		s.housekeeping.Describe(ch)
+	}
+	for _, q := range s.customQueries {
+		q.Describe(ch)
+	}
+	if s.customSuccess != nil {
+		s.customSuccess.Describe(ch)
+	}
+}
+
+// Start starts the background reads of the tables for housekeeping, if any, and prepares the scrape queries in the
+// background, so that a slow or unavailable database does not delay the exporter. Only the exporter needs them,
+// not the commands that run once.
+func (s *SQLClient) Start() {
+	if s.PrepareStatements {
+		go s.prepareStatements()
+	}
+	if s.housekeeping != nil {
+		s.housekeeping.Start(s)
+	}
+}
+
+// Close stops the background reads of the tables for housekeeping, if any.
+func (s *SQLClient) Close() error {
+	if s.housekeeping != nil {
+		s.housekeeping.Stop()
+	}
+	return nil
+}
+
+// Collect delivers the metrics reported by the SQL client itself. It implements prometheus.Collector.
+func (s *SQLClient) Collect(ch chan<- prometheus.Metric) {
+	s.queryDuration.Collect(ch)
+	s.queryRows.Collect(ch)
+	s.dbStats.Collect(ch)
+	for _, c := range s.events {
+		c.Collect(ch)
+	}
+	if s.housekeeping != nil {
+		s.housekeeping.Collect(ch)
+	}
+	for _, q := range s.customQueries {
+		q.Collect(ch)
+	}
+	if s.customSuccess != nil {
+		s.customSuccess.Collect(ch)
+	}
+}
+
+// queryRows is the result of a query. Closing it also ends the read-only transaction the query ran in, if any.
+type queryRows struct {
+	*sql.Rows
+	tx     *sql.Tx
+	reset  []string // Run in the transaction before it is rolled back
+	cancel context.CancelFunc
+	count  int
+	done   func(count int) // Called with the number of rows read once closed, if set
+}
+
+// Next prepares the next row for reading, counting the rows read.
+func (r *queryRows) Next() bool {
+	if !r.Rows.Next() {
+		return false
+	}
+	r.count++
+	return true
+}
+
+// Close closes the rows, then rolls back the transaction, as nothing is written.
+func (r *queryRows) Close() error {
+	var err error
+	if r.Rows != nil {
+		err = r.Rows.Close()
+	}
+	if r.tx != nil {
+		// The reset fails if the context is done, but then the driver has already closed the connection.
+		for _, statement := range r.reset {
+			if _, err := r.tx.Exec(statement); err != nil {
+				log.WithField("error", err).WithField("statement", statement).Debug("Session reset statement failed")
+				break
+			}
+		}
+		r.tx.Rollback()
+		r.tx = nil
+	}
+	if r.cancel != nil {
+		r.cancel()
+	}
+	if r.done != nil {
+		done := r.done
+		r.done = nil
+		done(r.count)
+	}
+	return err
+}
+
+// query runs a named query, logging and recording its duration.
+func (s *SQLClient) query(name string, query string, args ...interface{}) (*queryRows, error) {
+	return s.queryContext(context.Background(), name, query, args...)
+}
+
+// queryContext runs a named query with a context, logging and recording its duration.
+func (s *SQLClient) queryContext(ctx context.Context, name string, query string, args ...interface{}) (*queryRows, error) {
+	start := time.Now()
+	db := s.database()
+	stmt, err := s.statement(ctx, db, name, query)
+	var rows *queryRows
+	if err == nil {
+		rows, err = s.sessionQuery(ctx, db, stmt, query, args...)
+	}
+	elapsed := time.Since(start)
+	s.queryDuration.WithLabelValues(name).Set(elapsed.Seconds())
+	elapsed = elapsed.Round(time.Millisecond)
+	if err != nil {
+		log.WithField("elapsed", elapsed).WithField("error", err).WithField("query", name).WithField("sql", query).Debug("SQL query failed")
+		return nil, errors.Wrap(err, "SQL query failed")
+	}
+	log.WithField("elapsed", elapsed).WithField("query", name).Debug("SQL query succeeded")
+	rows.done = func(count int) {
+		s.queryRows.WithLabelValues(name).Set(float64(count))
+	}
+	return rows, nil
+}
+
+// sessionQuery runs a query on a database handle, or its prepared statement if not nil, in a read-only transaction
+// with the session settings if they are set. The statement timeout is also applied to the context, so that the
+// driver cancels the query if the database does not.
+func (s *SQLClient) sessionQuery(ctx context.Context, db *sql.DB, stmt *sql.Stmt, query string, args ...interface{}) (*queryRows, error) {
+	if s.session == nil {
+		var rows *sql.Rows
+		var err error
+		if stmt != nil {
+			rows, err = stmt.QueryContext(ctx, args...)
+		} else {
+			rows, err = db.QueryContext(ctx, query, args...)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &queryRows{Rows: rows}, nil
+	}
+
+	r := &queryRows{}
+	if s.session.timeout > 0 {
+		ctx, r.cancel = context.WithTimeout(ctx, s.session.timeout)
+	}
+	tx, err := db.BeginTx(ctx, s.session.options)
+	if err != nil {
+		r.Close()
+		return nil, errors.Wrap(err, "transaction start failed")
+	}
+	r.tx = tx
+	r.reset = s.session.resetStatements
+	for _, statement := range s.session.statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			r.Close()
+			return nil, errors.Wrapf(err, "session statement failed: %s", statement)
+		}
+	}
+	if stmt != nil {
+		r.Rows, err = tx.StmtContext(ctx, stmt).QueryContext(ctx, args...)
+	} else {
+		r.Rows, err = tx.QueryContext(ctx, query, args...)
+	}
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// brokerIDs returns the IDs of all Brokers in the reporting database.
+func (s *SQLClient) brokerIDs() ([]int, error) {
+	rows, err := s.query(brokersQuery, s.queries[brokersQuery])
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			log.WithField("error", err).Debug("Row scan failed")
+			return nil, errors.Wrap(err, "row scan failed")
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		log.WithField("error", err).Debug("Row processing failed")
+		return nil, errors.Wrap(err, "row processing failed")
+	}
+	return ids, nil
+}
+
+// latestReports runs a named latest report query, and returns the reports by Broker ID.
+func (s *SQLClient) latestReports(name string, query string, args ...interface{}) (map[int]BrokerReport, error) {
+	rows, err := s.query(name, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := map[int]BrokerReport{}
+	for rows.Next() {
+		brokerID, r, err := s.scanReport(rows.Rows)
+		if err != nil {
+			return nil, err
+		}
+
+		// GridServer records a report every 30 seconds.
+		// Log a warning if the timestamp is more than 60 seconds old, or exclude the Broker if the
+		// report is older than the stale threshold. This is likely to be a transient error e.g. during a reboot.
+		age := time.Since(r.Timestamp).Round(time.Second)
+		if s.StaleThreshold > 0 && age > s.StaleThreshold {
+			r.Stale = true
+			log.WithField("age", age).WithField("hostname", r.Hostname).WithField("name", r.Name).WithField("id", brokerID).Warn("Most recent report for Broker is stale, excluding from grid report")
+		} else if age > 1*time.Minute {
+			log.WithField("age", age).WithField("hostname", r.Hostname).WithField("name", r.Name).WithField("id", brokerID).Warn("Most recent report for Broker is more than 60 seconds old")
+		}
+
+		reports[brokerID] = r
+	}
+	err = rows.Err()
+	if err != nil {
+		log.WithField("error", err).Debug("Row processing failed")
+		return nil, errors.Wrap(err, "row processing failed")
+	}
+	return reports, nil
+}
+
+// scanReport scans a row with the columns of the latest report query, and returns the Broker ID and report.
+func (s *SQLClient) scanReport(rows *sql.Rows) (int, BrokerReport, error) {
+	var brokerID int
+	var brokerURL string
+	var ts time.Time
+	r := BrokerReport{}
+
+	err := rows.Scan(&brokerID, &brokerURL, &r.Name, &r.BusyEngines, &r.TotalEngines, &r.Drivers, &r.UptimeMinutes, &r.ServicesRunning, &r.TasksPending, &ts)
+	if err != nil {
+		log.WithField("error", err).Debug("Row scan failed")
+		return 0, r, errors.Wrap(err, "row scan failed")
+	}
+
+	r.ID = strconv.Itoa(brokerID)
+	r.URL = brokerURL
+	parsedURL, err := url.Parse(brokerURL)
+	if err == nil {
+		r.Hostname = parsedURL.Hostname()
+	}
+	r.Timestamp = s.fromDatabaseTime(ts)
+	return brokerID, r, nil
+}
+
+// windowedReports returns the latest report of each Broker, only scanning the reports within the query window.
+// Any Brokers without a report in the window fall back to a scan of all of their reports.
+func (s *SQLClient) windowedReports() (map[int]BrokerReport, error) {
+	ids, err := s.brokerIDs()
+	if err != nil {
+		return nil, err
+	}
+	reports, err := s.latestReports(windowQuery, s.queries[windowQuery], s.toDatabaseTime(time.Now().Add(-s.QueryWindow)))
+	if err != nil {
+		return nil, err
+	}
+
+	missing := []interface{}{}
+	for _, id := range ids {
+		if _, ok := reports[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) == 0 {
+		return reports, nil
+	}
+
+	log.WithField("brokers", len(missing)).WithField("window", s.QueryWindow).Debug("Brokers without reports in query window")
+	condition := fmt.Sprintf("broker_stats.broker_id IN (%s)", placeholders(s.dialect, 1, len(missing)))
+	fallback, err := s.latestReports(fallbackQuery, compact(s.dialect.LatestQuery(s.quotedSchema, condition)), missing...)
+	if err != nil {
+		return nil, err
+	}
+	for id, r := range fallback {
+		reports[id] = r
+	}
+	return reports, nil
+}
+
+// aggregates returns the aggregates of the reports within the aggregate window by Broker ID.
+// The average is of a decimal, so that SQL Server does not truncate it to an integer.
+func (s *SQLClient) aggregates() (map[int]*BrokerAggregates, error) {
+	rows, err := s.query(aggregateQuery, s.queries[aggregateQuery], s.toDatabaseTime(time.Now().Add(-s.AggregateWindow)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	aggregates := map[int]*BrokerAggregates{}
+	for rows.Next() {
+		var brokerID int
+		a := &BrokerAggregates{}
+		if err := rows.Scan(&brokerID, &a.MaxBusyEngines, &a.AvgBusyEngines, &a.MaxTasksPending, &a.MinTotalEngines); err != nil {
+			log.WithField("error", err).Debug("Row scan failed")
+			return nil, errors.Wrap(err, "row scan failed")
+		}
+		aggregates[brokerID] = a
+	}
+	if err := rows.Err(); err != nil {
+		log.WithField("error", err).Debug("Row processing failed")
+		return nil, errors.Wrap(err, "row processing failed")
+	}
+	return aggregates, nil
+}
+
+// readEvents counts the events since the previous scrape, and saves the watermarks.
+func (s *SQLClient) readEvents() {
+	for _, c := range s.events {
+		if err := c.Read(s); err != nil {
+			log.WithField("error", err).Warn("Events read failed")
+		}
+	}
+	if s.state != nil {
+		if err := s.state.Save(); err != nil {
+			log.WithField("error", err).WithField("path", s.state.path).Warn("State file save failed")
+		}
+	}
+}
+
+// runCustomQueries runs the user-defined queries. A failed query does not fail the scrape,
+// or prevent the other queries from running.
+func (s *SQLClient) runCustomQueries() {
+	for _, q := range s.customQueries {
+		if err := q.Run(s, s.Timeout); err != nil {
+			s.customSuccess.WithLabelValues(q.config.Name).Set(0)
+			log.WithField("error", err).WithField("query", q.config.Name).Warn("User-defined query failed")
+			continue
+		}
+		s.customSuccess.WithLabelValues(q.config.Name).Set(1)
+	}
 }
 
 // Fetch retrieves the most recent Broker reports from the reporting database
@@ -125,8 +832,14 @@ func (s *SQLClient) Fetch() func() (GridReport, []BrokerReport, error) {
 		grid := GridReport{TasksRunning: -1}
 		brokers := []BrokerReport{}
 
+		if s.passwordFile != nil {
+			if err := s.refreshPassword(); err != nil {
+				return grid, nil, err
+			}
+		}
+
 		start := time.Now()
-		err := s.db.Ping()
+		err := s.database().Ping()
 		elapsed := time.Since(start).Round(time.Millisecond)
 		if err != nil {
 			log.WithField("elapsed", elapsed).WithField("error", err).Debug("Database connection failed")
@@ -134,54 +847,55 @@ func (s *SQLClient) Fetch() func() (GridReport, []BrokerReport, error) {
 		}
 		log.WithField("elapsed", elapsed).Debug("Database connection succeeded")
 
-		query := fmt.Sprintf(queryTmpl, s.Schema)        // Insert the schema
-		query = strings.Join(strings.Fields(query), " ") // Remove the line breaks and tabs for logs
+		if s.TimeZone == autoTimeZone {
+			if err := s.detectTimeZone(); err != nil {
+				log.WithField("error", err).Warn("Database time zone detection failed")
+			}
+		}
 
-		start = time.Now()
-		rows, err := s.db.Query(query)
-		elapsed = time.Since(start).Round(time.Millisecond)
+		var reports map[int]BrokerReport
+		if s.QueryWindow > 0 {
+			reports, err = s.windowedReports()
+		} else {
+			reports, err = s.latestReports(latestQuery, s.queries[latestQuery])
+		}
 		if err != nil {
-			log.WithField("elapsed", elapsed).WithField("error", err).WithField("sql", query).Debug("SQL query failed")
-			return grid, nil, errors.Wrap(err, "SQL query failed")
+			return grid, nil, err
 		}
-		defer rows.Close()
-		log.WithField("elapsed", elapsed).Debug("SQL query succeeded")
-
-		for rows.Next() {
-			var brokerID int
-			var brokerURL string
-			var ts time.Time
-			r := BrokerReport{}
 
-			err = rows.Scan(&brokerID, &brokerURL, &r.Name, &r.BusyEngines, &r.TotalEngines, &r.Drivers, &r.UptimeMinutes, &r.ServicesRunning, &r.TasksPending, &ts)
+		// Aggregates are not essential, so failures are logged rather than failing the scrape.
+		if s.AggregateWindow > 0 {
+			aggregates, err := s.aggregates()
 			if err != nil {
-				log.WithField("error", err).Debug("Row scan failed")
-				return grid, nil, errors.Wrap(err, "row scan failed")
+				log.WithField("error", err).Warn("Aggregates read failed")
 			}
-
-			parsedURL, err := url.Parse(brokerURL)
-			if err == nil {
-				r.Hostname = parsedURL.Hostname()
+			for id, a := range aggregates {
+				if r, ok := reports[id]; ok {
+					r.Aggregates = a
+					reports[id] = r
+				}
 			}
+		}
 
-			brokers = append(brokers, r)
-
-			// GridServer records a report every 30 seconds.
-			// Log a warning if the timestamp is more than 60 seconds old.
-			// This is likely to be a transient error e.g. during a reboot.
-			age := time.Since(ts).Round(time.Second)
-			if age > 1*time.Minute {
-				log.WithField("age", age).WithField("hostname", r.Hostname).WithField("name", r.Name).WithField("id", brokerID).Warn("Most recent report for Broker is more than 60 seconds old")
-			}
+		// Report the Brokers in a consistent order.
+		ids := make([]int, 0, len(reports))
+		for id := range reports {
+			ids = append(ids, id)
 		}
-		err = rows.Err()
-		if err != nil {
-			log.WithField("error", err).Debug("Row processing failed")
-			return grid, nil, errors.Wrap(err, "row processing failed")
+		sort.Ints(ids)
+		for _, id := range ids {
+			brokers = append(brokers, reports[id])
 		}
 
+		// Events are not essential either.
+		s.readEvents()
+		s.runCustomQueries()
+
 		// Add up the individual broker reports to calculate an entire grid report.
 		for _, broker := range brokers {
+			if broker.Stale {
+				continue
+			}
 			grid.BusyEngines += broker.BusyEngines
 			grid.TotalEngines += broker.TotalEngines
 			grid.Drivers += broker.Drivers
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// stateFile persists the event table watermarks between restarts, so that events
+// recorded while the exporter is not running are still counted.
+type stateFile struct {
+	path       string
+	mutex      sync.Mutex
+	watermarks map[string]time.Time
+	changed    bool
+}
+
+// state is the contents of a state file.
+type state struct {
+	Watermarks map[string]time.Time `json:"watermarks"`
+}
+
+// loadStateFile reads a state file. A missing file is treated as an empty state.
+func loadStateFile(path string) (*stateFile, error) {
+	f := &stateFile{path: path, watermarks: map[string]time.Time{}}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "state file read failed")
+	}
+	s := state{}
+	if err := json.Unmarshal(content, &s); err != nil {
+		return nil, errors.Wrap(err, "state file parse failed")
+	}
+	for table, watermark := range s.Watermarks {
+		f.watermarks[table] = watermark
+	}
+	return f, nil
+}
+
+// Watermark returns the watermark for a table, and whether it was set.
+func (f *stateFile) Watermark(table string) (time.Time, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	watermark, ok := f.watermarks[table]
+	return watermark, ok
+}
+
+// SetWatermark sets the watermark for a table. It is not written until the state file is saved.
+func (f *stateFile) SetWatermark(table string, watermark time.Time) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if current, ok := f.watermarks[table]; ok && current.Equal(watermark) {
+		return
+	}
+	f.watermarks[table] = watermark
+	f.changed = true
+}
+
+// Save writes the state file if it has changed. The file is replaced atomically,
+// so that it is not left partially written if the exporter stops.
+func (f *stateFile) Save() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if !f.changed {
+		return nil
+	}
+
+	content, err := json.MarshalIndent(state{Watermarks: f.watermarks}, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "state file write failed")
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "state file write failed")
+	}
+	defer os.Remove(tmp.Name()) // Fails harmlessly once renamed
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "state file write failed")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "state file write failed")
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return errors.Wrap(err, "state file write failed")
+	}
+	f.changed = false
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	f, err := loadStateFile(path)
+	if err != nil {
+		t.Fatalf("expected missing state file to be empty, got %v", err)
+	}
+	if _, ok := f.Watermark("job_events"); ok {
+		t.Errorf("expected no watermark in empty state")
+	}
+
+	// Nothing is written until a watermark is set.
+	if err := f.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected no state file to be written, got %v", err)
+	}
+
+	watermark := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	f.SetWatermark("job_events", watermark)
+	if err := f.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = loadStateFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := f.Watermark("job_events")
+	if !ok || !got.Equal(watermark) {
+		t.Errorf("Watermark() = %v, %v, want %v, true", got, ok, watermark)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("expected only the state file in %s, got %d files", dir, len(files))
+	}
+}
+
+func TestLoadStateFile_Invalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+	if err := ioutil.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadStateFile(path); err == nil {
+		t.Errorf("expected non-nil error")
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// statement returns the prepared statement for a named query on a database handle, preparing it on first use, or nil
+// if the query is not prepared. Only the fixed queries are prepared, as the text of the other queries may change
+// between runs. The database/sql package prepares the statement again on each new connection, so it survives
+// reconnects, but the statements are prepared again if the handle is replaced.
+func (s *SQLClient) statement(ctx context.Context, db *sql.DB, name string, query string) (*sql.Stmt, error) {
+	if !s.PrepareStatements || s.queries[name] != query {
+		return nil, nil
+	}
+	s.statementsMutex.Lock()
+	defer s.statementsMutex.Unlock()
+	if s.statementsDB != db {
+		for _, stmt := range s.statements {
+			stmt.Close()
+		}
+		s.statements = nil
+		s.statementsDB = db
+	}
+	if stmt, ok := s.statements[name]; ok {
+		return stmt, nil
+	}
+	stmt, err := db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, errors.Wrap(err, "SQL prepare failed")
+	}
+	if s.statements == nil {
+		s.statements = map[string]*sql.Stmt{}
+	}
+	s.statements[name] = stmt
+	log.WithField("query", name).Debug("SQL query prepared")
+	return stmt, nil
+}
+
+// closeStatements closes the prepared statements, so that they are prepared again on the next use.
+func (s *SQLClient) closeStatements() {
+	s.statementsMutex.Lock()
+	defer s.statementsMutex.Unlock()
+	for _, stmt := range s.statements {
+		stmt.Close()
+	}
+	s.statements = nil
+}
+
+// planQuery is a fixed query run by the scrapes, with sample arguments for explaining its plan.
+type planQuery struct {
+	name string
+	args []interface{}
+}
+
+// scrapeQueries returns the fixed queries run by the scrapes with the options of the client.
+func (s *SQLClient) scrapeQueries() []planQuery {
+	now := s.toDatabaseTime(time.Now())
+	queries := []planQuery{}
+	if s.TimeZone == autoTimeZone {
+		queries = append(queries, planQuery{name: timeZoneQuery})
+	}
+	if s.QueryWindow > 0 {
+		queries = append(queries, planQuery{name: brokersQuery}, planQuery{name: windowQuery, args: []interface{}{now}})
+	} else {
+		queries = append(queries, planQuery{name: latestQuery})
+	}
+	if s.AggregateWindow > 0 {
+		queries = append(queries, planQuery{name: aggregateQuery, args: []interface{}{now}})
+	}
+	return queries
+}
+
+// prepareStatements prepares the fixed queries run by the scrapes, and logs their text and plan hash, so that a
+// changed plan (e.g. after a database upgrade) can be spotted by comparing the logs. It runs once in the background
+// when the exporter starts, as reading a plan costs extra queries, and may need extra privileges. A query that cannot
+// be prepared (e.g. while the database is down) is prepared on first use instead. Once a plan cannot be read, the
+// failure is logged, and the remaining queries are logged without reading their plans.
+func (s *SQLClient) prepareStatements() {
+	ctx := context.Background()
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+	db := s.database()
+	readPlans := true
+	for _, q := range s.scrapeQueries() {
+		query := s.queries[q.name]
+		stmt, err := s.statement(ctx, db, q.name, query)
+		if err != nil {
+			log.WithField("error", err).WithField("query", q.name).Warn("SQL query prepare failed, preparing it on first use instead")
+			continue
+		}
+		fields := log.WithField("query", q.name).WithField("sql", query)
+		if readPlans {
+			hash, err := s.planHash(db, stmt, query, q.args...)
+			if err != nil {
+				log.WithField("error", err).WithField("query", q.name).Warn("SQL query plan read failed, logging the queries without plans")
+				readPlans = false
+			} else if len(hash) > 0 {
+				fields = fields.WithField("plan_hash", hash)
+			}
+		}
+		fields.Info("SQL query prepared")
+	}
+}
+
+// planHash returns the plan hash of a query, or an empty string if there is none (e.g. the plan is not cached).
+// An explained plan is hashed, as not all databases report a plan hash. Otherwise, the query (or its prepared
+// statement, if not nil) is run once first, so that its plan is cached. The queries are limited to the statement
+// timeout, if greater than 0.
+func (s *SQLClient) planHash(db *sql.DB, stmt *sql.Stmt, query string, args ...interface{}) (string, error) {
+	ctx := context.Background()
+	if s.StatementTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.StatementTimeout)
+		defer cancel()
+	}
+	planQuery, explain := s.dialect.PlanQuery(query)
+	if !explain {
+		if err := s.runOnce(ctx, db, stmt, query, args...); err != nil {
+			return "", err
+		}
+		args = nil
+	}
+	rows, err := s.sessionQuery(ctx, db, nil, planQuery, args...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return "", err
+	}
+	lines := []string{}
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return "", errors.Wrap(err, "row scan failed")
+		}
+		line := make([]string, len(values))
+		for i, v := range values {
+			line[i] = v.String
+		}
+		lines = append(lines, strings.Join(line, "\t"))
+	}
+	if err := rows.Err(); err != nil {
+		return "", errors.Wrap(err, "row processing failed")
+	}
+
+	if !explain {
+		if len(lines) == 0 {
+			return "", nil
+		}
+		return strings.TrimSpace(lines[0]), nil
+	}
+	h := fnv.New64a()
+	h.Write([]byte(strings.Join(lines, "\n")))
+	return fmt.Sprintf("%016x", h.Sum64()), nil
+}
+
+// runOnce runs a query and discards its rows.
+func (s *SQLClient) runOnce(ctx context.Context, db *sql.DB, stmt *sql.Stmt, query string, args ...interface{}) error {
+	rows, err := s.sessionQuery(ctx, db, stmt, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+	}
+	return errors.Wrap(rows.Err(), "row processing failed")
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+func TestSQLClient_PrepareStatements(t *testing.T) {
+	db, fake := newFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		if strings.HasPrefix(query, "EXPLAIN") {
+			return fakeResult{columns: []string{"QUERY PLAN"}, rows: [][]driver.Value{{"Seq Scan on brokers"}}}
+		}
+		return fakeResult{columns: []string{"broker_id"}, rows: [][]driver.Value{{int64(1)}, {int64(2)}}}
+	})
+	s := newTestSQLClient("postgres", "", "public", time.Second)
+	s.db = db
+	s.PrepareStatements = true
+	s.QueryWindow = 5 * time.Minute
+
+	count := func(queries []string, query string) int {
+		n := 0
+		for _, q := range queries {
+			if q == query {
+				n++
+			}
+		}
+		return n
+	}
+	explained := func() int {
+		n := 0
+		for _, q := range fake.Queries() {
+			if strings.HasPrefix(q.query, "EXPLAIN") {
+				n++
+			}
+		}
+		return n
+	}
+	run := func(times int) {
+		for i := 0; i < times; i++ {
+			if _, err := s.brokerIDs(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// The scrape queries are prepared and their plans explained at startup, with sample arguments.
+	s.prepareStatements()
+	for _, name := range []string{brokersQuery, windowQuery} {
+		if expect, got := 1, count(fake.Prepared(), s.queries[name]); expect != got {
+			t.Errorf("expected the %s query to be prepared %d times, got %d", name, expect, got)
+		}
+	}
+	if expect, got := 2, explained(); expect != got {
+		t.Errorf("expected %d plans to be explained, got %d", expect, got)
+	}
+	if args := fake.Queries()[1].args; len(args) != 1 {
+		t.Errorf("expected the window query to be explained with 1 argument, got %v", args)
+	}
+
+	// Running the queries neither prepares them again nor explains them.
+	run(3)
+	if expect, got := 1, count(fake.Prepared(), s.queries[brokersQuery]); expect != got {
+		t.Errorf("expected the query to be prepared %d times, got %d", expect, got)
+	}
+	if expect, got := 2, explained(); expect != got {
+		t.Errorf("expected %d plans to be explained, got %d", expect, got)
+	}
+	if expect, got := 2., readGauge(s.queryRows.WithLabelValues(brokersQuery)); expect != got {
+		t.Errorf("expected %f query rows, got %f", expect, got)
+	}
+
+	// The statements are prepared again after reconnecting.
+	s.closeStatements()
+	run(2)
+	if expect, got := 2, count(fake.Prepared(), s.queries[brokersQuery]); expect != got {
+		t.Errorf("expected the query to be prepared %d times, got %d", expect, got)
+	}
+	if expect, got := 2, explained(); expect != got {
+		t.Errorf("expected %d plans to be explained, got %d", expect, got)
+	}
+}
+
+func TestSQLClient_PrepareStatementsPlanFailure(t *testing.T) {
+	db, fake := newFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		if strings.Contains(query, "dm_exec_query_stats") {
+			return fakeResult{err: fmt.Errorf("VIEW SERVER STATE permission denied")}
+		}
+		return fakeResult{columns: []string{"broker_id"}}
+	})
+	s := newTestSQLClient("sqlserver", "", "dbo", time.Second)
+	s.db = db
+	s.PrepareStatements = true
+	s.QueryWindow = 5 * time.Minute
+	s.AggregateWindow = 5 * time.Minute
+
+	// All of the queries are prepared, but the plans are not read again after the first failure. The first query
+	// runs once before its plan is read.
+	s.prepareStatements()
+	if expect, got := 3, len(s.statements); expect != got {
+		t.Errorf("expected %d prepared statements, got %d", expect, got)
+	}
+	if expect, got := 2, len(fake.Queries()); expect != got {
+		t.Errorf("expected %d queries, got %d", expect, got)
+	}
+}
+
+func TestSQLClient_Start(t *testing.T) {
+	db, fake := newFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		return fakeResult{columns: []string{"QUERY PLAN"}, rows: [][]driver.Value{{"Seq Scan on broker_stats"}}}
+	})
+	s := newTestSQLClient("postgres", "", "public", time.Second)
+	s.db = db
+	s.PrepareStatements = true
+
+	// The scrape queries are prepared in the background.
+	s.Start()
+	defer s.Close()
+	for deadline := time.Now().Add(time.Second); len(fake.Queries()) < 1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the statements to be prepared")
+		}
+	}
+	s.statementsMutex.Lock()
+	defer s.statementsMutex.Unlock()
+	if _, ok := s.statements[latestQuery]; len(s.statements) != 1 || !ok {
+		t.Errorf("expected the latest query to be prepared, got %v", s.statements)
+	}
+}
+
+func TestSQLClient_PrepareStatementsDisabled(t *testing.T) {
+	db, fake := newFakeDB(t, func(query string, args []driver.Value) fakeResult {
+		return fakeResult{columns: []string{"broker_id"}, rows: [][]driver.Value{{int64(1)}}}
+	})
+	s := newTestSQLClient("postgres", "", "public", time.Second)
+	s.db = db
+
+	for i := 0; i < 2; i++ {
+		if _, err := s.brokerIDs(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Each run is prepared by database/sql, and the plan is not explained.
+	if diff := deep.Equal(fake.Prepared(), []string{s.queries[brokersQuery], s.queries[brokersQuery]}); diff != nil {
+		t.Errorf("prepared = %v: %s", fake.Prepared(), diff)
+	}
+	if expect, got := 1., readGauge(s.queryRows.WithLabelValues(brokersQuery)); expect != got {
+		t.Errorf("expected %f query rows, got %f", expect, got)
+	}
+}
+
+func TestSQLClient_planHash(t *testing.T) {
+	ts := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	seqScan := [][]driver.Value{{"Seq Scan on broker_stats"}, {"  Filter: (time_stamp >= $1)"}}
+	tests := []struct {
+		name     string
+		driver   string
+		schema   string
+		rows     [][]driver.Value
+		want     string
+		wantArgs []driver.Value
+	}{
+		{"Explain", "postgres", "public", seqScan, "", []driver.Value{ts}},
+		{"ExplainChanged", "postgres", "public", [][]driver.Value{{"Index Scan using broker_stats_time_stamp on broker_stats"}}, "", []driver.Value{ts}},
+		{"Lookup", "sqlserver", "dbo", [][]driver.Value{{"0x8C7D1E0F2A3B4C5D"}}, "0x8C7D1E0F2A3B4C5D", []driver.Value{}},
+		{"NotCached", "godror", "gridserver", [][]driver.Value{}, "", []driver.Value{}},
+	}
+	hashes := map[string]string{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, fake := newFakeDB(t, func(query string, args []driver.Value) fakeResult {
+				return fakeResult{columns: []string{"plan"}, rows: tt.rows}
+			})
+			s := newTestSQLClient(tt.driver, "", tt.schema, time.Second)
+			s.db = db
+			got, err := s.planHash(db, nil, s.queries[windowQuery], ts)
+			if err != nil {
+				t.Fatalf("planHash() error = %v", err)
+			}
+			if explain := len(tt.wantArgs) > 0; explain && len(got) != 16 {
+				t.Errorf("planHash() = %q, want a 16 digit hash", got)
+			} else if !explain && got != tt.want {
+				t.Errorf("planHash() = %q, want %q", got, tt.want)
+			}
+			hashes[tt.name] = got
+			// A plan that is not explained is read from the plan cache after running the query once.
+			queries := fake.Queries()
+			if explain := len(tt.wantArgs) > 0; !explain {
+				if len(queries) != 2 || queries[0].query != s.queries[windowQuery] {
+					t.Fatalf("expected the query to run before the plan query, got %v", queries)
+				}
+				if diff := deep.Equal(queries[0].args, []driver.Value{ts}); diff != nil {
+					t.Errorf("query arguments: %s", diff)
+				}
+				queries = queries[1:]
+			}
+			if len(queries) != 1 || !strings.Contains(queries[0].query, strings.Replace(s.queries[windowQuery], "'", "''", -1)) {
+				t.Fatalf("expected a single plan query, got %v", queries)
+			}
+			if diff := deep.Equal(queries[0].args, tt.wantArgs); diff != nil {
+				t.Errorf("plan query arguments: %s", diff)
+			}
+		})
+	}
+	if hashes["Explain"] == hashes["ExplainChanged"] {
+		t.Errorf("expected a changed plan to change the hash")
+	}
+	if hashes["NotCached"] != "" {
+		t.Errorf("expected no hash for a plan not cached, got %q", hashes["NotCached"])
+	}
+}
+
+// TestSQLClient_PrepareStatementsSQLite runs prepared statements on a SQLite fixture file, with and without
+// read-only transactions.
+func TestSQLClient_PrepareStatementsSQLite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statements")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "reporting.db")
+
+	fixture, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statements := []string{
+		"CREATE TABLE brokers (broker_id INTEGER)",
+		"INSERT INTO brokers VALUES (2)",
+		"INSERT INTO brokers VALUES (4)",
+	}
+	for _, statement := range statements {
+		if _, err := fixture.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fixture.Close()
+
+	for _, readOnly := range []bool{false, true} {
+		s, err := NewSQLClient("sqlite://"+path, Credentials{}, "", time.Second, SQLOptions{PrepareStatements: true, ReadOnly: readOnly})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A single connection, so that running the plan query while the query is open would block.
+		s.db.SetMaxOpenConns(1)
+		for i := 0; i < 3; i++ {
+			ids, err := s.brokerIDs()
+			if err != nil {
+				t.Fatalf("read-only %t: %v", readOnly, err)
+			}
+			if diff := deep.Equal(ids, []int{2, 4}); diff != nil {
+				t.Errorf("read-only %t: brokerIDs() = %v: %s", readOnly, ids, diff)
+			}
+		}
+		// Only the queries that have run are prepared, as the client has not been started.
+		if _, ok := s.statements[brokersQuery]; len(s.statements) != 1 || !ok {
+			t.Errorf("read-only %t: expected the brokers query to be prepared, got %v", readOnly, s.statements)
+		}
+		if hash, err := s.planHash(s.database(), s.statements[brokersQuery], s.queries[brokersQuery]); err != nil || len(hash) != 16 {
+			t.Errorf("read-only %t: planHash() = %q, %v", readOnly, hash, err)
+		}
+		s.closeStatements()
+		s.db.Close()
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// autoTimeZone is the time zone setting for detecting the time zone of the database server on each scrape.
+const autoTimeZone = "auto"
+
+// loadTimeZone returns the location for a time zone setting, or nil if the timestamps are used as returned by the
+// driver (the setting is empty) or the time zone is detected from the database server.
+func loadTimeZone(name string) (*time.Location, error) {
+	if len(name) == 0 || name == autoTimeZone {
+		return nil, nil
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid time zone")
+	}
+	return location, nil
+}
+
+// databaseLocation returns the database time zone, which is read by the housekeeping reads in the background.
+func (s *SQLClient) databaseLocation() *time.Location {
+	s.locationMutex.RLock()
+	defer s.locationMutex.RUnlock()
+	return s.location
+}
+
+// fromDatabaseTime interprets a timestamp from the reporting database as a wall clock time in the database time zone.
+// The timestamp columns (e.g. Oracle DATE or SQL Server DATETIME) have no time zone, so the drivers return them as UTC.
+func (s *SQLClient) fromDatabaseTime(t time.Time) time.Time {
+	location := s.databaseLocation()
+	if location == nil {
+		return t
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), location)
+}
+
+// toDatabaseTime converts a time to the wall clock time in the database time zone, for comparing with timestamp columns.
+func (s *SQLClient) toDatabaseTime(t time.Time) time.Time {
+	location := s.databaseLocation()
+	if location == nil {
+		return t
+	}
+	t = t.In(location)
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+// detectTimeZone sets the database time zone to the current UTC offset of the database server.
+// The offset is detected on each scrape, so that daylight saving time changes are followed.
+func (s *SQLClient) detectTimeZone() error {
+	rows, err := s.query(timeZoneQuery, s.queries[timeZoneQuery])
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var offset int64
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			log.WithField("error", err).Debug("Row processing failed")
+			return errors.Wrap(err, "row processing failed")
+		}
+		return fmt.Errorf("time zone offset not returned")
+	}
+	if err := rows.Scan(&offset); err != nil {
+		log.WithField("error", err).Debug("Row scan failed")
+		return errors.Wrap(err, "row scan failed")
+	}
+	if location := s.databaseLocation(); location != nil {
+		if _, current := time.Now().In(location).Zone(); int64(current) == offset {
+			return nil
+		}
+	}
+	s.locationMutex.Lock()
+	s.location = time.FixedZone("", int(offset))
+	s.locationMutex.Unlock()
+	log.WithField("offset", time.Duration(offset)*time.Second).Info("Database time zone detected")
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_loadTimeZone(t *testing.T) {
+	tests := []struct {
+		name     string
+		zone     string
+		wantName string
+		wantErr  bool
+	}{
+		{"NotSet", "", "", false},
+		{"Auto", "auto", "", false},
+		{"UTC", "UTC", "UTC", false},
+		{"Named", "Australia/Sydney", "Australia/Sydney", false},
+		{"Invalid", "Mars/Olympus_Mons", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := loadTimeZone(tt.zone)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadTimeZone() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			gotName := ""
+			if got != nil {
+				gotName = got.String()
+			}
+			if gotName != tt.wantName {
+				t.Errorf("loadTimeZone() = %q, want %q", gotName, tt.wantName)
+			}
+		})
+	}
+}
+
+func TestSQLClient_FetchTimeZone(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	honolulu := time.FixedZone("", -10*60*60)
+	// The driver returns the wall clock time in Honolulu, labelled as UTC, so it appears to be 10 hours old.
+	wall := now.In(honolulu)
+	stored := time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), wall.Second(), 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		zone      string
+		offset    driver.Value
+		wantStale bool
+	}{
+		{"NotSet", "", nil, true},
+		{"Configured", "Pacific/Honolulu", nil, false},
+		{"Auto", "auto", int64(-36000), false},
+		{"AutoFailed", "auto", "not a number", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var windowArg time.Time
+			db, _ := newFakeDB(t, func(query string, args []driver.Value) fakeResult {
+				switch {
+				case strings.Contains(query, "TIMEZONE"):
+					return fakeResult{columns: []string{"offset"}, rows: [][]driver.Value{{tt.offset}}}
+				case strings.HasPrefix(query, "SELECT broker_id FROM"):
+					return fakeResult{columns: []string{"broker_id"}, rows: [][]driver.Value{{int64(1)}}}
+				default:
+					windowArg = args[0].(time.Time)
+					return fakeResult{columns: latestColumns, rows: [][]driver.Value{latestRow(1, stored)}}
+				}
+			})
+			s := newTestSQLClient("postgres", "", "public", time.Second)
+			s.db = db
+			s.QueryWindow = 5 * time.Minute
+			s.StaleThreshold = 90 * time.Second
+			s.TimeZone = tt.zone
+			s.location, _ = loadTimeZone(tt.zone)
+
+			_, brokers, err := s.Fetch()()
+			if err != nil {
+				t.Fatalf("Fetch() error = %v", err)
+			}
+			if len(brokers) != 1 {
+				t.Fatalf("Fetch() returned %d brokers, want 1", len(brokers))
+			}
+			if brokers[0].Stale != tt.wantStale {
+				t.Errorf("Fetch() stale = %v, want %v", brokers[0].Stale, tt.wantStale)
+			}
+			if tt.wantStale {
+				return
+			}
+			if !brokers[0].Timestamp.Equal(now) {
+				t.Errorf("Fetch() timestamp = %v, want %v", brokers[0].Timestamp, now)
+			}
+			// The query window start is passed as the Honolulu wall clock time.
+			if want := stored.Add(-s.QueryWindow); windowArg.Sub(want) > time.Minute || want.Sub(windowArg) > time.Minute {
+				t.Errorf("Window query argument = %v, want about %v", windowArg, want)
+			}
+		})
+	}
+}
+
+func TestSQLClient_detectTimeZone(t *testing.T) {
+	for _, offset := range []int64{-12600, 0, 36000} {
+		t.Run(fmt.Sprint(offset), func(t *testing.T) {
+			db, _ := newFakeDB(t, func(query string, args []driver.Value) fakeResult {
+				return fakeResult{columns: []string{"offset"}, rows: [][]driver.Value{{offset}}}
+			})
+			s := newTestSQLClient("godror", "", "public", time.Second)
+			s.db = db
+			if err := s.detectTimeZone(); err != nil {
+				t.Fatalf("detectTimeZone() error = %v", err)
+			}
+			if _, got := time.Now().In(s.location).Zone(); int64(got) != offset {
+				t.Errorf("detectTimeZone() offset = %d, want %d", got, offset)
+			}
+		})
+	}
+}
+
+// TestSQLiteTimeZoneOffsetQuery runs the SQLite query, which returns the offset of the local time zone of the host.
+func TestSQLiteTimeZoneOffsetQuery(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var got int
+	if err := db.QueryRow(sqliteDialect{}.TimeZoneOffsetQuery()).Scan(&got); err != nil {
+		t.Fatal(err)
+	}
+	if _, want := time.Now().Zone(); got != want {
+		t.Errorf("TimeZoneOffsetQuery() = %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// topologyCache holds the most recent Broker list returned by the Director, refreshed in the background, so that
+// scrapes do not call the Director and the Brokers can still be scraped directly while the Director is unavailable.
+type topologyCache struct {
+	mutex      sync.RWMutex
+	ttl        time.Duration
+	brokers    []*BrokerInfo
+	updated    time.Time
+	directorUp bool // Whether the last refresh succeeded
+	stop       chan struct{}
+	stopOnce   sync.Once
+}
+
+func newTopologyCache(ttl time.Duration) *topologyCache {
+	return &topologyCache{ttl: ttl, stop: make(chan struct{})}
+}
+
+// Set replaces the cached Broker list.
+func (t *topologyCache) Set(brokers []*BrokerInfo, now time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.brokers = brokers
+	t.updated = now
+	t.directorUp = true
+}
+
+// Fail records a failed refresh. The cached Broker list is kept until it expires.
+func (t *topologyCache) Fail() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.directorUp = false
+}
+
+// Get returns the cached Broker list and its age, if the list is no older than the TTL.
+func (t *topologyCache) Get(now time.Time) ([]*BrokerInfo, time.Duration, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	age := now.Sub(t.updated)
+	if t.updated.IsZero() || age > t.ttl {
+		return nil, age, false
+	}
+	return t.brokers, age, true
+}
+
+// DirectorUp returns whether the last refresh of the Broker list succeeded.
+func (t *topologyCache) DirectorUp() bool {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.directorUp
+}
+
+// Age returns the time since the Broker list was last updated, or a negative duration if it has never been set.
+func (t *topologyCache) Age(now time.Time) time.Duration {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if t.updated.IsZero() {
+		return -1
+	}
+	return now.Sub(t.updated)
+}
+
+// Start calls refresh at every interval in a background goroutine until Stop is called.
+func (t *topologyCache) Start(interval time.Duration, refresh func() ([]*BrokerInfo, error)) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-t.stop:
+				return
+			case <-ticker.C:
+				brokers, err := refresh()
+				if err != nil {
+					t.Fail()
+					continue
+				}
+				t.Set(brokers, time.Now())
+			}
+		}
+	}()
+}
+
+// Stop stops the background refresh. It is safe to call more than once.
+func (t *topologyCache) Stop() {
+	t.stopOnce.Do(func() { close(t.stop) })
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTopologyCache(t *testing.T) {
+	now := time.Now()
+	c := newTopologyCache(time.Minute)
+
+	if _, _, ok := c.Get(now); ok {
+		t.Errorf("expected empty cache to be unavailable")
+	}
+	if expect, got := time.Duration(-1), c.Age(now); expect != got {
+		t.Errorf("expected age %v, got %v", expect, got)
+	}
+
+	brokers := []*BrokerInfo{newBrokerInfo("broker", 1, 0, 0, 0)}
+	c.Set(brokers, now)
+
+	got, age, ok := c.Get(now.Add(30 * time.Second))
+	if !ok {
+		t.Fatalf("expected fresh cache to be available")
+	}
+	if expect := 30 * time.Second; expect != age {
+		t.Errorf("expected age %v, got %v", expect, age)
+	}
+	if len(got) != 1 || got[0].Name != "broker" {
+		t.Errorf("expected cached Brokers %v, got %v", brokers, got)
+	}
+
+	if _, _, ok := c.Get(now.Add(2 * time.Minute)); ok {
+		t.Errorf("expected expired cache to be unavailable")
+	}
+}
+
+func TestTopologyCache_Start(t *testing.T) {
+	c := newTopologyCache(time.Minute)
+	defer c.Stop()
+	refreshes := make(chan bool)
+	c.Start(time.Millisecond, func() ([]*BrokerInfo, error) {
+		if <-refreshes {
+			return []*BrokerInfo{newBrokerInfo("broker", 1, 0, 0, 0)}, nil
+		}
+		return nil, fmt.Errorf("director unavailable")
+	})
+	// The state is stored after the refresh returns, so wait for it.
+	wait := func(condition func() bool) {
+		for deadline := time.Now().Add(time.Second); !condition(); time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("timed out waiting for the refresh")
+			}
+		}
+	}
+
+	refreshes <- true
+	wait(func() bool { _, _, ok := c.Get(time.Now()); return ok })
+	if !c.DirectorUp() {
+		t.Errorf("expected the Director to be up after a successful refresh")
+	}
+
+	refreshes <- false
+	wait(func() bool { return !c.DirectorUp() })
+	if _, _, ok := c.Get(time.Now()); !ok {
+		t.Errorf("expected the Broker list to be kept after a failed refresh")
+	}
+
+	// Stop is safe to call more than once.
+	c.Stop()
+}